@@ -1,10 +1,35 @@
 package main
 
+import (
+	"fmt"
+	"regexp"
+)
+
 // Artifacts contains docker images to be built and optionally publish them
 type Artifacts struct {
 	Registry string `yaml:",omitempty"` // default registry value
 	Images   []ImageConfig
 	Publish  []string // branch/tag's to publish images on
+	// allow publishing from a working tree with uncommitted changes
+	AllowDirty bool `yaml:"allow_dirty,omitempty"`
+	// file, relative to the context, the digests of the published images are
+	// written to
+	DigestsFile string `yaml:"digests_file,omitempty"`
+	// Export saves the images as files when publishing or by the export target
+	Export ExportConfig `yaml:",omitempty"`
+	// registries, i.e. localhost:5000, served over plain http which are pushed
+	// to without requiring auth
+	Insecure []string `yaml:"insecure_registries,omitempty"`
+}
+
+// IsInsecure returns whether the registry is marked as insecure
+func (art *Artifacts) IsInsecure(registry string) bool {
+	for _, r := range art.Insecure {
+		if r == registry {
+			return registry != ""
+		}
+	}
+	return false
 }
 
 // ValidateImageConfigs validates all image configs
@@ -47,3 +72,70 @@ func (art *Artifacts) setDefaults() {
 	}
 
 }
+
+// publishRef is an image path to push along with the registry it is pushed to
+type publishRef struct {
+	Registry string
+	Path     string
+}
+
+// PublishRefs returns the image paths to push for the branch/tag.  Only the
+// registries whose publish conditions match are included.  The conditions of a
+// registry default to those of the image then of the artifacts.  If images are
+// named they are pushed to all their registries regardless of the conditions.
+func (art *Artifacts) PublishRefs(branchTag string, names ...string) ([]publishRef, error) {
+	var (
+		refs   []publishRef
+		images []*ImageConfig
+	)
+	if len(names) == 0 {
+		for i := range art.Images {
+			images = append(images, &art.Images[i])
+		}
+	} else {
+		for _, name := range names {
+			ic := art.GetImage(name)
+			if ic == nil {
+				return nil, fmt.Errorf("no such artifact: %s", name)
+			}
+			images = append(images, ic)
+		}
+	}
+
+	for _, ic := range images {
+		for _, rc := range ic.PublishTargets() {
+			if len(names) == 0 {
+				conds := rc.Publish
+				if conds == nil {
+					conds = art.Publish
+				}
+				if !matchPublish(conds, branchTag) {
+					continue
+				}
+			}
+			for _, p := range rc.Paths(ic.Name) {
+				reg := rc.Registry
+				if reg == "" {
+					// i.e. localhost:5000/app
+					reg = imageRegistry(p)
+				}
+				refs = append(refs, publishRef{Registry: reg, Path: p})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// matchPublish returns whether the branch/tag matches any of the conditions.  A
+// condition is the branch/tag, a regular expression or * for all.
+func matchPublish(conds []string, branchTag string) bool {
+	for _, p := range conds {
+		if p == branchTag || p == "*" {
+			return true
+		}
+		if m, err := regexp.MatchString(p, branchTag); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_Artifacts(t *testing.T) {
 	mc, err := readMoldConfig("./testdata/mold2.yml")
@@ -21,3 +24,74 @@ func Test_Artifacts(t *testing.T) {
 		}
 	}
 }
+
+func Test_Artifacts_PublishRefs(t *testing.T) {
+	art := Artifacts{
+		Publish: []string{"master"},
+		Images: []ImageConfig{
+			{Name: "app", Registries: []RegistryConfig{
+				{Registry: "staging", Tags: []string{"latest"}},
+				{Registry: "prod", Tags: []string{"1.0.0"}, Publish: []string{`^v\d+\.\d+\.\d+$`}},
+			}},
+			{Name: "tool", Publish: []string{"*"}},
+			{Name: "other", Publish: []string{}},
+		},
+	}
+
+	paths := func(refs []publishRef) string {
+		var pp []string
+		for _, r := range refs {
+			pp = append(pp, r.Path)
+		}
+		return strings.Join(pp, ",")
+	}
+	for branchTag, want := range map[string]string{
+		"master":  "staging/app:latest,tool",
+		"v1.0.0":  "prod/app:1.0.0,tool",
+		"feature": "tool",
+	} {
+		refs, err := art.PublishRefs(branchTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := paths(refs); p != want {
+			t.Errorf("%s: have=%s want=%s", branchTag, p, want)
+		}
+	}
+
+	// named images are published to all registries
+	refs, err := art.PublishRefs("feature", "app", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := paths(refs); p != "staging/app:latest,prod/app:1.0.0,other" {
+		t.Fatal(p)
+	}
+	if refs[1].Registry != "prod" {
+		t.Fatal("wrong registry", refs[1].Registry)
+	}
+	if _, err = art.PublishRefs("master", "none"); err == nil {
+		t.Fatal("should fail on unknown image")
+	}
+}
+
+func Test_Artifacts_Insecure(t *testing.T) {
+	art := Artifacts{
+		Publish:  []string{"*"},
+		Insecure: []string{"localhost:5000"},
+		Images:   []ImageConfig{{Name: "localhost:5000/app"}, {Name: "app", Registry: "localhost:5000"}},
+	}
+	if !art.IsInsecure("localhost:5000") || art.IsInsecure("") || art.IsInsecure("localhost") {
+		t.Fatal("wrong insecure registries")
+	}
+
+	refs, err := art.PublishRefs("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if ref.Registry != "localhost:5000" {
+			t.Fatalf("registry should be from the name: %+v", ref)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	units "github.com/docker/go-units"
+)
+
+// Labels applied to cache volumes so they can be listed and pruned
+const (
+	cacheLabel     = "mold.cache"
+	cacheRepoLabel = "mold.cache.repo"
+	cachePathLabel = "mold.cache.path"
+	cacheKeyLabel  = "mold.cache.key"
+	cacheStepLabel = "mold.cache.step"
+	cacheUsedLabel = "mold.cache.used"
+)
+
+var invalidVolumeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// cacheVolume is a named volume persisting a directory of the build container
+// across runs.
+type cacheVolume struct {
+	Name   string
+	Path   string // mount path in the container
+	KeySum string // hash of the key file if specified
+}
+
+// Labels returns the labels the volume is created with
+func (cv *cacheVolume) Labels(repo string) map[string]string {
+	return map[string]string{
+		cacheLabel:     "true",
+		cacheRepoLabel: repo,
+		cachePathLabel: cv.Path,
+		cacheKeyLabel:  cv.KeySum,
+	}
+}
+
+// Mount returns the mount for the build container
+func (cv *cacheVolume) Mount() mount.Mount {
+	return mount.Mount{Type: mount.TypeVolume, Source: cv.Name, Target: cv.Path}
+}
+
+// newCacheVolume returns the cache volume for the config.  The name is keyed by
+// the repo, path and the contents of the key file if any.
+func newCacheVolume(repo, contextDir string, cfg CacheVolumeConfig) (*cacheVolume, error) {
+	if !path.IsAbs(cfg.Path) {
+		return nil, fmt.Errorf("cache path must be absolute: %s", cfg.Path)
+	}
+	cv := &cacheVolume{Path: path.Clean(cfg.Path)}
+
+	ph := sha256.Sum256([]byte(cv.Path))
+	cv.Name = fmt.Sprintf("mold-cache-%s-%x", invalidVolumeChars.ReplaceAllString(repo, "_"), ph[:4])
+
+	if cfg.Key != "" {
+		kf := cfg.Key
+		if !filepath.IsAbs(kf) {
+			kf = filepath.Join(contextDir, kf)
+		}
+		b, err := ioutil.ReadFile(kf)
+		if err != nil {
+			return nil, fmt.Errorf("cache key: %v", err)
+		}
+		kh := sha256.Sum256(b)
+		cv.KeySum = fmt.Sprintf("%x", kh)
+		cv.Name += "-" + cv.KeySum[:12]
+	}
+	return cv, nil
+}
+
+// getCacheKeyHash returns the sha256 of the build hash along with the contents of
+// the cache key inputs.  Env. var values are looked up in the step env. first
+// followed by the process env.
+func getCacheKeyHash(buildHash, contextDir string, env []string, ck *CacheKeyConfig) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, buildHash+"\n")
+
+	var files []string
+	seen := map[string]bool{}
+	for _, pattern := range ck.Files {
+		p := pattern
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(contextDir, p)
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return "", fmt.Errorf("cache key: %v", err)
+		}
+		if len(matches) == 0 {
+			return "", fmt.Errorf("cache key: no files match %s", pattern)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", fmt.Errorf("cache key: %v", err)
+		}
+		if fi.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("cache key: %v", err)
+		}
+		rel, _ := filepath.Rel(contextDir, f)
+		fmt.Fprintf(h, "file:%s:%x\n", filepath.ToSlash(rel), sha256.Sum256(b))
+	}
+
+	for _, v := range ck.Values {
+		fmt.Fprintf(h, "value:%s\n", v)
+	}
+
+	for _, name := range ck.Env {
+		val, ok := lookupEnv(env, name)
+		if !ok {
+			val = os.Getenv(name)
+		}
+		fmt.Fprintf(h, "env:%s=%s\n", name, val)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// lookupEnv returns the value of the last definition of name in the env. list
+func lookupEnv(env []string, name string) (string, bool) {
+	var (
+		val   string
+		found bool
+	)
+	for _, e := range env {
+		pp := strings.SplitN(e, "=", 2)
+		if pp[0] == name {
+			found = true
+			if len(pp) == 2 {
+				val = pp[1]
+			}
+		}
+	}
+	return val, found
+}
+
+// buildCacheVolumes returns the cache volumes for a build step
+func buildCacheVolumes(mc *MoldConfig, b DockerRunConfig) ([]*cacheVolume, error) {
+	cvs := make([]*cacheVolume, len(b.Caches))
+	for i, c := range b.Caches {
+		cv, err := newCacheVolume(mc.RepoName, mc.Context, c)
+		if err != nil {
+			return nil, err
+		}
+		cvs[i] = cv
+	}
+	return cvs, nil
+}
+
+// setupCacheVolumes creates the labelled cache volumes.  Existing volumes are
+// reused as is.
+func (dw *DockerWorker) setupCacheVolumes(ctx context.Context) error {
+	for _, cs := range dw.buildStates {
+		for _, cv := range cs.caches {
+			if err := dw.docker.CreateVolume(ctx, cv.Name, cv.Labels(dw.buildConfig.RepoName)); err != nil {
+				return err
+			}
+			dw.log.Write([]byte(fmt.Sprintf("[setup/cache/%s] %s\n", cv.Name, cv.Path)))
+		}
+	}
+	return nil
+}
+
+// repoCacheVolumes returns all cache volumes of the repo along with their usage
+func (dw *DockerWorker) repoCacheVolumes(ctx context.Context) ([]*types.Volume, error) {
+	du, err := dw.docker.Client().DiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var vols []*types.Volume
+	for _, v := range du.Volumes {
+		if v.Labels[cacheLabel] == "true" && v.Labels[cacheRepoLabel] == dw.buildConfig.RepoName {
+			vols = append(vols, v)
+		}
+	}
+	return vols, nil
+}
+
+// inUseCacheVolumes returns the names of the cache volumes referenced by the
+// current config
+func (dw *DockerWorker) inUseCacheVolumes() map[string]bool {
+	names := map[string]bool{}
+	for _, cs := range dw.buildStates {
+		for _, cv := range cs.caches {
+			names[cv.Name] = true
+		}
+	}
+	return names
+}
+
+// cacheImageName returns the name of the cached build images of the repo,
+// prefixed with the registry if one is configured.
+func cacheImageName(registry, repo string) string {
+	name := "cache-" + repo
+	if registry = strings.TrimSuffix(registry, "/"); registry != "" {
+		name = registry + "/" + name
+	}
+	return name
+}
+
+// registryHost returns the host portion of a registry with optional namespace
+func registryHost(registry string) string {
+	return strings.SplitN(registry, "/", 2)[0]
+}
+
+// pullCacheImage tries to pull the cache image of the step from the cache
+// registry.  It reports whether the image is now available locally.  Failures,
+// including the image not existing, are logged and treated as a miss.
+func (dw *DockerWorker) pullCacheImage(ctx context.Context, cs *containerState) bool {
+	reg := dw.buildConfig.CacheRegistry
+	if reg == "" || dw.buildConfig.Offline {
+		return false
+	}
+	prefix := fmt.Sprintf("[build/%s...]", cs.shortName)
+	img := cs.cache.ToString()
+	auth := dw.getRegistryAuth(registryHost(reg))
+	if err := dw.docker.PullImage(ctx, img, auth, dw.log, prefix); err != nil {
+		dw.log.Write([]byte(fmt.Sprintf("%s Cache not pulled %s: %v\n", prefix, img, err)))
+		return false
+	}
+	return dw.docker.ImageAvailableLocally(ctx, img)
+}
+
+// pushCacheImage pushes the committed cache image of the step to the cache
+// registry if one is configured.
+func (dw *DockerWorker) pushCacheImage(ctx context.Context, cs *containerState) error {
+	reg := dw.buildConfig.CacheRegistry
+	if reg == "" || !cs.cache.IsSet() {
+		return nil
+	}
+	prefix := fmt.Sprintf("[build/%s...]", cs.shortName)
+	img := cs.cache.ToString()
+	if err := dw.docker.PushImage(ctx, img, dw.getRegistryAuth(registryHost(reg)), dw.log, prefix); err != nil {
+		return err
+	}
+	dw.log.Write([]byte(fmt.Sprintf("%s Cache pushed %s\n", prefix, img)))
+	return nil
+}
+
+// buildStepName returns the name identifying a build step across runs
+func buildStepName(i int, b DockerRunConfig) string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return fmt.Sprintf("%d-%s", i, nameFromImageName(b.Image))
+}
+
+// Labels returns the labels applied to the committed cache image
+func (ic *cache) Labels(repo string) map[string]string {
+	return map[string]string{
+		cacheLabel:     "true",
+		cacheRepoLabel: repo,
+		cacheStepLabel: ic.Step,
+		cacheUsedLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+// cacheImageLastUsed returns the time the cached image was last committed
+func cacheImageLastUsed(img types.ImageSummary) time.Time {
+	if v, err := strconv.ParseInt(img.Labels[cacheUsedLabel], 10, 64); err == nil {
+		return time.Unix(v, 0)
+	}
+	return time.Unix(img.Created, 0)
+}
+
+// repoCacheImages returns the cached build images of the repo most recently
+// used first
+func (dw *DockerWorker) repoCacheImages(ctx context.Context) ([]types.ImageSummary, error) {
+	imgs, err := dw.docker.ListImages(ctx, cacheRepoLabel+"="+dw.buildConfig.RepoName)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(imgs, func(i, j int) bool {
+		return cacheImageLastUsed(imgs[i]).After(cacheImageLastUsed(imgs[j]))
+	})
+	return imgs, nil
+}
+
+// currentCacheImages returns the cache image references of the current config
+func (dw *DockerWorker) currentCacheImages() map[string]bool {
+	refs := map[string]bool{}
+	for _, cs := range dw.buildStates {
+		if cs.cache.IsSet() {
+			refs[cs.cache.ToString()] = true
+		}
+	}
+	return refs
+}
+
+// expiredCacheImages returns the images to remove per the retention policy.  The
+// images must be sorted most recently used first.  Images referenced by the
+// current config are never expired.
+func expiredCacheImages(imgs []types.ImageSummary, crc CacheRetentionConfig, current map[string]bool, now time.Time) []types.ImageSummary {
+	var (
+		expired   []types.ImageSummary
+		kept      []types.ImageSummary
+		perStep   = map[string]int{}
+		isCurrent = func(img types.ImageSummary) bool {
+			for _, t := range img.RepoTags {
+				if current[t] {
+					return true
+				}
+			}
+			return false
+		}
+	)
+
+	for _, img := range imgs {
+		if isCurrent(img) {
+			kept = append(kept, img)
+			perStep[img.Labels[cacheStepLabel]]++
+			continue
+		}
+		step := img.Labels[cacheStepLabel]
+		switch {
+		case crc.Keep > 0 && perStep[step] >= crc.Keep:
+			expired = append(expired, img)
+		case crc.maxAge > 0 && now.Sub(cacheImageLastUsed(img)) > crc.maxAge:
+			expired = append(expired, img)
+		default:
+			perStep[step]++
+			kept = append(kept, img)
+		}
+	}
+
+	if crc.maxSize > 0 {
+		var total int64
+		for _, img := range kept {
+			total += img.Size
+		}
+		// remove the least recently used first
+		for i := len(kept) - 1; i >= 0 && total > crc.maxSize; i-- {
+			if isCurrent(kept[i]) {
+				continue
+			}
+			total -= kept[i].Size
+			expired = append(expired, kept[i])
+		}
+	}
+	return expired
+}
+
+// removeCacheImages removes the images writing what was removed
+func (dw *DockerWorker) removeCacheImages(ctx context.Context, imgs []types.ImageSummary, wr io.Writer) error {
+	var err error
+	for _, img := range imgs {
+		if e := dw.docker.RemoveImage(ctx, img.ID, true, true); e != nil {
+			err = mergeErrors(err, e)
+			continue
+		}
+		wr.Write([]byte(fmt.Sprintf("[cache] Removed %s %s %s\n", strings.Join(img.RepoTags, ","),
+			img.Labels[cacheStepLabel], units.HumanSize(float64(img.Size)))))
+	}
+	return err
+}
+
+// enforceCacheRetention removes cached build images of the repo per the
+// configured retention policy
+func (dw *DockerWorker) enforceCacheRetention(ctx context.Context) error {
+	crc := dw.buildConfig.CacheRetention
+	if !crc.IsSet() || len(dw.currentCacheImages()) == 0 {
+		return nil
+	}
+	imgs, err := dw.repoCacheImages(ctx)
+	if err != nil {
+		return err
+	}
+	return dw.removeCacheImages(ctx, expiredCacheImages(imgs, crc, dw.currentCacheImages(), time.Now()), dw.log)
+}
+
+// ListCaches writes the cache images and volumes of the repo to the writer
+func (dw *DockerWorker) ListCaches(ctx context.Context, wr io.Writer) error {
+	imgs, err := dw.repoCacheImages(ctx)
+	if err != nil {
+		return err
+	}
+	refs := dw.currentCacheImages()
+
+	tw := tabwriter.NewWriter(wr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSTEP\tSIZE\tLAST USED\tCURRENT")
+	for _, img := range imgs {
+		var current bool
+		for _, t := range img.RepoTags {
+			current = current || refs[t]
+		}
+		tags := strings.Join(img.RepoTags, ",")
+		if tags == "" {
+			tags = img.ID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s ago\t%t\n", tags, img.Labels[cacheStepLabel],
+			units.HumanSize(float64(img.Size)), units.HumanDuration(time.Since(cacheImageLastUsed(img))), current)
+	}
+	fmt.Fprintln(tw)
+
+	vols, err := dw.repoCacheVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	current := dw.inUseCacheVolumes()
+
+	fmt.Fprintln(tw, "VOLUME\tPATH\tKEY\tSIZE\tCURRENT")
+	for _, v := range vols {
+		size := "-"
+		if v.UsageData != nil && v.UsageData.Size >= 0 {
+			size = units.HumanSize(float64(v.UsageData.Size))
+		}
+		key := v.Labels[cacheKeyLabel]
+		if len(key) > 12 {
+			key = key[:12]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", v.Name, v.Labels[cachePathLabel], key, size, current[v.Name])
+	}
+	return tw.Flush()
+}
+
+// PruneCaches removes cached build images per the retention policy, or all not
+// referenced by the current config if no policy is set.  It also removes cache
+// volumes of the repo that are no longer referenced by the config i.e. their key
+// changed.  Volumes in use by containers are skipped.
+func (dw *DockerWorker) PruneCaches(ctx context.Context, wr io.Writer) error {
+	imgs, err := dw.repoCacheImages(ctx)
+	if err != nil {
+		return err
+	}
+	crc := dw.buildConfig.CacheRetention
+	if !crc.IsSet() {
+		// everything but the current ones has expired
+		crc.maxAge = time.Nanosecond
+	}
+	err = dw.removeCacheImages(ctx, expiredCacheImages(imgs, crc, dw.currentCacheImages(), time.Now()), wr)
+
+	vols, e := dw.repoCacheVolumes(ctx)
+	if e != nil {
+		return mergeErrors(err, e)
+	}
+	current := dw.inUseCacheVolumes()
+
+	for _, v := range vols {
+		if current[v.Name] || (v.UsageData != nil && v.UsageData.RefCount > 0) {
+			continue
+		}
+		if e := dw.docker.RemoveVolume(ctx, v.Name, false); e != nil {
+			err = mergeErrors(err, e)
+			continue
+		}
+		wr.Write([]byte(fmt.Sprintf("[cache] Removed %s %s\n", v.Name, strings.TrimSpace(v.Labels[cachePathLabel]))))
+	}
+	return err
+}
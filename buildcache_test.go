@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func Test_newCacheVolume(t *testing.T) {
+	d, err := ioutil.TempDir("", "mold-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	cv, err := newCacheVolume("my/repo", d, CacheVolumeConfig{Path: "/go/pkg/mod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cv.Name, "mold-cache-my_repo-") || cv.KeySum != "" {
+		t.Fatalf("bad volume: %+v", cv)
+	}
+	if m := cv.Mount(); m.Target != "/go/pkg/mod" || m.Source != cv.Name {
+		t.Fatalf("bad mount: %+v", m)
+	}
+
+	if _, err = newCacheVolume("repo", d, CacheVolumeConfig{Path: "/go/pkg/mod", Key: "go.sum"}); err == nil {
+		t.Fatal("should fail with missing key file")
+	}
+
+	kf := filepath.Join(d, "go.sum")
+	ioutil.WriteFile(kf, []byte("v1"), 0644)
+	cv1, err := newCacheVolume("repo", d, CacheVolumeConfig{Path: "/go/pkg/mod", Key: "go.sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(kf, []byte("v2"), 0644)
+	cv2, _ := newCacheVolume("repo", d, CacheVolumeConfig{Path: "/go/pkg/mod", Key: "go.sum"})
+	if cv1.Name == cv2.Name {
+		t.Fatal("key change should change the volume name")
+	}
+
+	if _, err = newCacheVolume("repo", d, CacheVolumeConfig{Path: "relative"}); err == nil {
+		t.Fatal("should fail with relative path")
+	}
+}
+
+func Test_getCacheKeyHash(t *testing.T) {
+	d, err := ioutil.TempDir("", "mold-cache-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	ioutil.WriteFile(filepath.Join(d, "a.lock"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(d, "b.lock"), []byte("b"), 0644)
+
+	ck := &CacheKeyConfig{Files: []string{"*.lock"}, Values: []string{"v1"}, Env: []string{"GOFLAGS"}}
+	env := []string{"GOFLAGS=-mod=vendor"}
+	h1, err := getCacheKeyHash("base", d, env, ck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2, _ := getCacheKeyHash("base", d, env, ck); h1 != h2 {
+		t.Fatal("hash should be stable")
+	}
+
+	ioutil.WriteFile(filepath.Join(d, "b.lock"), []byte("c"), 0644)
+	h2, _ := getCacheKeyHash("base", d, env, ck)
+	if h1 == h2 {
+		t.Fatal("file change should change the hash")
+	}
+	if h3, _ := getCacheKeyHash("base", d, []string{"GOFLAGS="}, ck); h3 == h2 {
+		t.Fatal("env change should change the hash")
+	}
+
+	ck.Files = []string{"missing.lock"}
+	if _, err = getCacheKeyHash("base", d, env, ck); err == nil {
+		t.Fatal("should fail with no matching files")
+	}
+}
+
+func Test_expiredCacheImages(t *testing.T) {
+	now := time.Now()
+	img := func(tag, step string, age time.Duration, size int64) types.ImageSummary {
+		return types.ImageSummary{
+			ID:       tag,
+			RepoTags: []string{tag},
+			Size:     size,
+			Labels: map[string]string{
+				cacheStepLabel: step,
+				cacheUsedLabel: strconv.FormatInt(now.Add(-age).Unix(), 10),
+			},
+		}
+	}
+	imgs := []types.ImageSummary{
+		img("cache-repo:a1", "a", time.Hour, 10),
+		img("cache-repo:b1", "b", 2*time.Hour, 10),
+		img("cache-repo:a2", "a", 3*time.Hour, 10),
+		img("cache-repo:a3", "a", 48*time.Hour, 10),
+	}
+	current := map[string]bool{"cache-repo:a2": true}
+	tags := func(in []types.ImageSummary) string {
+		var out []string
+		for _, i := range in {
+			out = append(out, i.RepoTags[0])
+		}
+		return strings.Join(out, ",")
+	}
+
+	crc := CacheRetentionConfig{Keep: 1}
+	if got := tags(expiredCacheImages(imgs, crc, current, now)); got != "cache-repo:a3" {
+		t.Fatal("keep:", got)
+	}
+
+	crc = CacheRetentionConfig{MaxAge: "24h"}
+	crc.parse()
+	if got := tags(expiredCacheImages(imgs, crc, current, now)); got != "cache-repo:a3" {
+		t.Fatal("max_age:", got)
+	}
+
+	crc = CacheRetentionConfig{MaxSize: "20B"}
+	crc.parse()
+	if got := tags(expiredCacheImages(imgs, crc, current, now)); got != "cache-repo:a3,cache-repo:b1" {
+		t.Fatal("max_size:", got)
+	}
+}
+
+func Test_cacheImageName(t *testing.T) {
+	if n := cacheImageName("", "mold"); n != "cache-mold" {
+		t.Fatal(n)
+	}
+	if n := cacheImageName("registry.example.com/ci/", "mold"); n != "registry.example.com/ci/cache-mold" {
+		t.Fatal(n)
+	}
+	if h := registryHost("registry.example.com:5000/ci"); h != "registry.example.com:5000" {
+		t.Fatal(h)
+	}
+}
+
+func Test_assembleBuildContainers_caches(t *testing.T) {
+	mc := &MoldConfig{
+		RepoName: "repo",
+		Context:  "/src",
+		Build:    []DockerRunConfig{{Image: "golang", Caches: []CacheVolumeConfig{{Path: "/go/pkg/mod"}}}, {Image: "alpine"}},
+	}
+	bc, caches, err := assembleBuildContainers(mc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caches) != 2 || len(caches[0]) != 1 || len(caches[1]) != 0 {
+		t.Fatalf("should be per step: %+v", caches)
+	}
+	// the volumes mounted are those returned
+	if m := bc[0].Host.Mounts[1]; m.Source != caches[0][0].Name || m.Target != "/go/pkg/mod" {
+		t.Fatalf("bad mount: %+v", m)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// buildInfo is the build metadata written into the context so it can be copied
+// into artifacts i.e. to serve from a version endpoint.
+type buildInfo struct {
+	Version      string `json:"version"`
+	VersionShort string `json:"version_short"`
+	Commit       string `json:"commit"`
+	CommitIndex  int    `json:"commit_index"`
+	BranchTag    string `json:"branch_tag"`
+	RepoURL      string `json:"repo_url,omitempty"`
+	BuildTime    string `json:"build_time"`
+	MoldVersion  string `json:"mold_version"`
+	RunID        string `json:"run_id"`
+}
+
+func (mc *MoldConfig) buildInfo(now time.Time) buildInfo {
+	return buildInfo{
+		Version:      mc.gitVersion.Version(),
+		VersionShort: mc.gitVersion.TagVersion(),
+		Commit:       mc.gitVersion.Commit(),
+		CommitIndex:  mc.gitVersion.distance,
+		BranchTag:    mc.BranchTag,
+		RepoURL:      mc.RepoURL,
+		BuildTime:    now.UTC().Format(time.RFC3339),
+		MoldVersion:  VERSION,
+		RunID:        mc.RunID,
+	}
+}
+
+// writeBuildInfo writes the build info into the context if configured
+func (mc *MoldConfig) writeBuildInfo() error {
+	if mc.BuildInfo == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(mc.buildInfo(time.Now()), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(mc.Context, mc.BuildInfo), append(b, '\n'), 0644)
+}
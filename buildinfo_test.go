@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_MoldConfig_writeBuildInfo(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.tag("v1.2.0", tr.commit("initial"))
+	tr.commit("fix: bug")
+
+	mc := &MoldConfig{
+		Context:    tr.dir,
+		BuildInfo:  "build-info.json",
+		BranchTag:  "master",
+		RunID:      "42",
+		gitVersion: tr.version(),
+	}
+	if err := mc.writeBuildInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(tr.dir, "build-info.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bi buildInfo
+	if err = json.Unmarshal(b, &bi); err != nil {
+		t.Fatal(err)
+	}
+	if bi.VersionShort != "1.2.0" || bi.Version != mc.gitVersion.Version() || bi.CommitIndex != 1 ||
+		bi.Commit != mc.gitVersion.Commit() || bi.BranchTag != "master" || bi.RunID != "42" ||
+		bi.MoldVersion != VERSION || bi.BuildTime == "" {
+		t.Fatalf("%+v", bi)
+	}
+
+	if _, err = NewMoldConfig([]byte("build_info: ../build-info.json\n")); err == nil {
+		t.Fatal("should fail outside of the context")
+	}
+}
+
+func Test_Worker_GenerateArtifacts_buildInfo(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.tag("v1.2.0", tr.commit("initial"))
+
+	var buf bytes.Buffer
+	dw := &DockerWorker{log: &Log{Writer: &buf}, buildConfig: &MoldConfig{
+		Context:    tr.dir,
+		BuildInfo:  "build-info.json",
+		gitVersion: tr.version(),
+	}}
+	// i.e. -t artifacts without setup
+	if err := dw.GenerateArtifacts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tr.dir, "build-info.json")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "[artifacts/build-info] Wrote") {
+		t.Fatal(buf.String())
+	}
+
+	// not rewritten once written this run
+	buf.Reset()
+	if err := dw.GenerateArtifacts(context.Background()); err != nil || buf.Len() != 0 {
+		t.Fatal(err, buf.String())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// buildOutput is a path in the build container to be copied to the host once
+// the build succeeds.  The last element of the container path may be a glob.
+type buildOutput struct {
+	Src string // absolute path in the container
+	Dst string // host path relative to the context
+}
+
+// parseBuildOutput parses an output of the form <container path>[:<host path>].
+// The host path defaults to the root of the context and may be a windows path
+// with a drive letter i.e. C:\out.
+func parseBuildOutput(s string) (buildOutput, error) {
+	out := buildOutput{Src: strings.TrimSpace(s), Dst: "."}
+	if i := outputSeparator(s); i >= 0 {
+		out.Src = strings.TrimSpace(s[:i])
+		if dst := strings.TrimSpace(s[i+1:]); dst != "" {
+			out.Dst = dst
+		}
+	}
+
+	if !path.IsAbs(out.Src) {
+		return out, fmt.Errorf("output container path must be absolute: %s", s)
+	}
+	if strings.ContainsAny(path.Dir(out.Src), "*?[") {
+		return out, fmt.Errorf("glob only supported in the last element: %s", s)
+	}
+	return out, nil
+}
+
+// outputSeparator returns the index of the ':' separating the container and
+// host paths or -1.  It is the last one not following a drive letter.
+func outputSeparator(s string) int {
+	for i := len(s) - 1; i > 0; i-- {
+		if s[i] != ':' {
+			continue
+		}
+		c := s[i-1]
+		drive := (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && (i == 1 || s[i-2] == ':')
+		if !drive {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsGlob reports whether the source is a glob
+func (bo buildOutput) IsGlob() bool {
+	return strings.ContainsAny(path.Base(bo.Src), "*?[")
+}
+
+// copySource returns the container path to request from the archive api
+func (bo buildOutput) copySource() string {
+	if bo.IsGlob() {
+		return path.Dir(bo.Src)
+	}
+	return bo.Src
+}
+
+// copyOutputs copies the declared outputs of a build container to the host
+func (dw *DockerWorker) copyOutputs(ctx context.Context, cs *containerState) error {
+	prefix := fmt.Sprintf("[build/%s...]", cs.shortName)
+	for _, out := range cs.outputs {
+		rc, err := dw.docker.CopyFromContainer(ctx, cs.ID(), out.copySource())
+		if err != nil {
+			return fmt.Errorf("output %s: %v", out.Src, err)
+		}
+
+		dst := dw.buildConfig.outputPath(out.Dst)
+		// a trailing separator or existing directory means copy into it
+		intoDir := out.IsGlob() || strings.HasSuffix(out.Dst, "/")
+		if fi, e := os.Stat(dst); e == nil && fi.IsDir() {
+			intoDir = true
+		}
+
+		n, err := extractOutput(rc, out, dst, intoDir, dw.log, prefix)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("output %s: %v", out.Src, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("output %s: no files matched", out.Src)
+		}
+	}
+	return nil
+}
+
+// extractOutput extracts the tar stream as returned by the archive api writing
+// matching entries under dst.  It returns the number of files written.
+func extractOutput(r io.Reader, out buildOutput, dst string, intoDir bool, wr io.Writer, prefix string) (int, error) {
+	var (
+		tr    = tar.NewReader(r)
+		n     int
+		files = map[string]string{} // archive name to the file written
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if strings.HasPrefix(name, "../") || name == ".." {
+			return n, fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+		// the first element is the base name of the requested path
+		pp := strings.SplitN(name, "/", 2)
+
+		var rel string
+		if out.IsGlob() {
+			if len(pp) == 1 {
+				continue
+			}
+			if ok, _ := path.Match(path.Base(out.Src), strings.SplitN(pp[1], "/", 2)[0]); !ok {
+				continue
+			}
+			rel = pp[1]
+		} else if intoDir {
+			rel = name
+		} else if len(pp) == 2 {
+			rel = pp[1]
+		}
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if err = checkNoSymlinks(dst, target); err != nil {
+			return n, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return n, err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			sum, err := writeOutputFile(target, tr, os.FileMode(hdr.Mode))
+			if err != nil {
+				return n, err
+			}
+			n++
+			files[name] = target
+			wr.Write([]byte(fmt.Sprintf("%s Output %s -> %s %d bytes sha256:%x\n",
+				prefix, path.Join(path.Dir(out.copySource()), name), target, hdr.Size, sum)))
+
+		case tar.TypeLink:
+			// hard links are copied from the file linked to if it was written
+			src, ok := files[path.Clean(hdr.Linkname)]
+			if !ok {
+				wr.Write([]byte(fmt.Sprintf("%s Output %s skipped, hard link to %s not in the output\n",
+					prefix, path.Join(path.Dir(out.copySource()), name), hdr.Linkname)))
+				continue
+			}
+			if err = copyOutputFile(src, target, os.FileMode(hdr.Mode)); err != nil {
+				return n, err
+			}
+			n++
+			files[name] = target
+			wr.Write([]byte(fmt.Sprintf("%s Output %s -> %s (hard link to %s)\n",
+				prefix, path.Join(path.Dir(out.copySource()), name), target, hdr.Linkname)))
+
+		case tar.TypeSymlink:
+			// links may only point within dst so nothing outside of it is
+			// exposed or written through later
+			link := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(link) || !withinDir(dst, filepath.Join(filepath.Dir(target), link)) {
+				return n, fmt.Errorf("symlink outside of the output in archive: %s -> %s", hdr.Name, hdr.Linkname)
+			}
+			os.Remove(target)
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// withinDir reports whether the path is dir or below it
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinks returns an error if target is outside of dst or any path
+// between them, i.e. a parent of target, is a symlink.  Extracting through a
+// symlink could write anywhere on the host.
+func checkNoSymlinks(dst, target string) error {
+	if !withinDir(dst, target) {
+		return fmt.Errorf("path outside of the output: %s", target)
+	}
+	rel, _ := filepath.Rel(dst, target)
+	if rel == "." {
+		return nil
+	}
+	p := dst
+	for _, elem := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink: %s", p)
+		}
+	}
+	return nil
+}
+
+// copyOutputFile copies an output file already written to target
+func copyOutputFile(src, target string, mode os.FileMode) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = writeOutputFile(target, fh, mode)
+	return err
+}
+
+// writeOutputFile writes the file returning its sha256 checksum.  An existing
+// symlink at target is replaced rather than followed.
+func writeOutputFile(target string, r io.Reader, mode os.FileMode) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(target); err != nil {
+			return nil, err
+		}
+	}
+	fh, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(fh, h), r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testOutputTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if content == "" {
+			tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func Test_parseBuildOutput(t *testing.T) {
+	out, err := parseBuildOutput("/go/bin/app:dist/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Src != "/go/bin/app" || out.Dst != "dist/app" || out.IsGlob() {
+		t.Fatalf("bad parse: %+v", out)
+	}
+
+	if out, err = parseBuildOutput("/src/target/*.jar"); err != nil {
+		t.Fatal(err)
+	}
+	if out.Dst != "." || !out.IsGlob() || out.copySource() != "/src/target" {
+		t.Fatalf("bad parse: %+v", out)
+	}
+
+	for s, dst := range map[string]string{
+		`/go/bin/app:C:\out\app`: `C:\out\app`,
+		"/go/bin/app:c:/out":     "c:/out",
+		"/go/bin/app:out/a:b":    "b", // last separator
+		"/go/bin/app":            ".",
+		"/go/bin/app:":           ".",
+	} {
+		if out, err = parseBuildOutput(s); err != nil {
+			t.Fatal(err)
+		}
+		if out.Dst != dst {
+			t.Errorf("%s: bad dst %s", s, out.Dst)
+		}
+	}
+
+	if _, err = parseBuildOutput("bin/app"); err == nil {
+		t.Fatal("should fail with relative path")
+	}
+	if _, err = parseBuildOutput("/src/*/app"); err == nil {
+		t.Fatal("should fail with glob in dir")
+	}
+}
+
+func Test_extractOutput(t *testing.T) {
+	d, err := ioutil.TempDir("", "mold-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	// single file renamed
+	r := testOutputTar(t, map[string]string{"app": "binary"})
+	out, _ := parseBuildOutput("/go/bin/app:dist/myapp")
+	n, err := extractOutput(r, out, filepath.Join(d, "myapp"), false, ioutil.Discard, "")
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d, "myapp")); string(b) != "binary" {
+		t.Fatalf("bad content: %s", b)
+	}
+
+	// glob into a directory
+	r = testOutputTar(t, map[string]string{"target": "", "target/a.jar": "a", "target/b.txt": "b"})
+	out, _ = parseBuildOutput("/src/target/*.jar:jars/")
+	n, err = extractOutput(r, out, filepath.Join(d, "jars"), true, ioutil.Discard, "")
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if _, err = os.Stat(filepath.Join(d, "jars", "a.jar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(d, "jars", "b.txt")); err == nil {
+		t.Fatal("should not match b.txt")
+	}
+
+	r = testOutputTar(t, map[string]string{"../evil": "x"})
+	out, _ = parseBuildOutput("/evil")
+	if _, err = extractOutput(r, out, filepath.Join(d, "evil"), false, ioutil.Discard, ""); err == nil {
+		t.Fatal("should fail with path traversal")
+	}
+}
+
+func Test_extractOutput_hardlinks(t *testing.T) {
+	d, err := ioutil.TempDir("", "mold-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 6})
+	tw.Write([]byte("binary"))
+	tw.WriteHeader(&tar.Header{Name: "bin/app-link", Typeflag: tar.TypeLink, Linkname: "bin/app", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "bin/other", Typeflag: tar.TypeLink, Linkname: "lib/missing", Mode: 0644})
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	out, _ := parseBuildOutput("/go/bin:dist/")
+	n, err := extractOutput(buf, out, filepath.Join(d, "dist"), true, &log, "")
+	if err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d, "dist", "bin", "app-link")); string(b) != "binary" {
+		t.Fatalf("hard link should be copied: %s", b)
+	}
+	if !strings.Contains(log.String(), "skipped, hard link to lib/missing") {
+		t.Fatal("should log the skipped link:", log.String())
+	}
+}
+
+func Test_extractOutput_symlinks(t *testing.T) {
+	d, err := ioutil.TempDir("", "mold-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	outside := filepath.Join(d, "outside")
+	dst := filepath.Join(d, "dist")
+	if err = os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := func(link string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: "out/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: "out/link", Typeflag: tar.TypeSymlink, Linkname: link})
+		tw.WriteHeader(&tar.Header{Name: "out/link/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("evil"))
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	out, _ := parseBuildOutput("/src/out:dist/")
+	for _, link := range []string{outside, "../../outside", "../.."} {
+		if _, err = extractOutput(archive(link), out, dst, true, ioutil.Discard, ""); err == nil {
+			t.Errorf("%s: should reject a symlink outside of the output", link)
+		}
+		if _, err = os.Stat(filepath.Join(outside, "x")); err == nil {
+			t.Fatalf("%s: wrote outside of the output", link)
+		}
+	}
+
+	// a link within the output is kept but never written through
+	os.RemoveAll(dst)
+	if _, err = extractOutput(archive("."), out, dst, true, ioutil.Discard, ""); err == nil {
+		t.Fatal("should refuse to write through a symlink")
+	}
+
+	// an existing symlink is replaced rather than followed
+	os.RemoveAll(dst)
+	os.MkdirAll(dst, 0755)
+	if err = os.Symlink(filepath.Join(outside, "app"), filepath.Join(dst, "app")); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = parseBuildOutput("/go/bin/app:dist/")
+	r := testOutputTar(t, map[string]string{"app": "binary"})
+	if _, err = extractOutput(r, out, dst, true, ioutil.Discard, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(outside, "app")); err == nil {
+		t.Fatal("wrote through an existing symlink")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// Changelog formats
+const (
+	changelogMarkdown = "markdown"
+	changelogJSON     = "json"
+)
+
+// section titles of the conventional commit types in the order rendered.  Any
+// other type is rendered after these.
+var changelogSections = []struct{ Type, Title string }{
+	{"breaking", "Breaking Changes"},
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"revert", "Reverts"},
+	{"docs", "Documentation"},
+	{"refactor", "Refactoring"},
+	{"test", "Tests"},
+	{"build", "Build"},
+	{"ci", "CI"},
+	{"chore", "Chores"},
+	{"", "Other"},
+}
+
+// ChangelogConfig writes the changelog into the context before the build so it
+// is available to the build containers and artifact images.
+type ChangelogConfig struct {
+	File   string `yaml:",omitempty"` // path relative to the context
+	Format string `yaml:",omitempty"` // markdown (default) or json
+}
+
+func (cc *ChangelogConfig) parse() error {
+	if cc.File == "" {
+		return nil
+	}
+	if err := validateContextFile("changelog", cc.File); err != nil {
+		return err
+	}
+	if cc.Format == "" {
+		if strings.HasSuffix(cc.File, ".json") {
+			cc.Format = changelogJSON
+		} else {
+			cc.Format = changelogMarkdown
+		}
+	}
+	return validateChangelogFormat(cc.Format)
+}
+
+func validateChangelogFormat(format string) error {
+	switch format {
+	case changelogMarkdown, changelogJSON:
+		return nil
+	}
+	return fmt.Errorf("changelog: invalid format: %s", format)
+}
+
+type changelogEntry struct {
+	Hash     string `json:"hash"`
+	Type     string `json:"type,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Subject  string `json:"subject"`
+	Breaking bool   `json:"breaking,omitempty"`
+}
+
+type changelogSection struct {
+	Type    string           `json:"type"`
+	Title   string           `json:"title"`
+	Entries []changelogEntry `json:"entries"`
+}
+
+// changelog is the commits between two refs grouped by conventional commit type
+type changelog struct {
+	Version  string             `json:"version"`
+	From     string             `json:"from,omitempty"`
+	To       string             `json:"to"`
+	Date     string             `json:"date"`
+	Sections []changelogSection `json:"sections"`
+}
+
+// newChangelog groups the commits, newest first, into sections.  Breaking
+// changes are listed both in their own section and under their type.
+func newChangelog(commits []*object.Commit) *changelog {
+	byType := map[string][]changelogEntry{}
+	for _, c := range commits {
+		typ, scope, subject, breaking := parseConventional(c.Message)
+		e := changelogEntry{
+			Hash:     c.Hash.String()[:7],
+			Type:     typ,
+			Scope:    scope,
+			Subject:  subject,
+			Breaking: breaking,
+		}
+		if breaking {
+			byType["breaking"] = append(byType["breaking"], e)
+		}
+		byType[typ] = append(byType[typ], e)
+	}
+
+	cl := &changelog{Date: time.Now().Format("2006-01-02")}
+	for _, s := range changelogSections {
+		if entries, ok := byType[s.Type]; ok {
+			cl.Sections = append(cl.Sections, changelogSection{Type: s.Type, Title: s.Title, Entries: entries})
+			delete(byType, s.Type)
+		}
+	}
+	// remaining unknown types
+	var types []string
+	for t := range byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		cl.Sections = append(cl.Sections, changelogSection{Type: t, Title: t, Entries: byType[t]})
+	}
+	return cl
+}
+
+// Markdown renders the changelog as markdown
+func (cl *changelog) Markdown() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "## %s (%s)\n", cl.Version, cl.Date)
+	for _, s := range cl.Sections {
+		fmt.Fprintf(&buf, "\n### %s\n\n", s.Title)
+		for _, e := range s.Entries {
+			if e.Scope != "" {
+				fmt.Fprintf(&buf, "- **%s:** %s (%s)\n", e.Scope, e.Subject, e.Hash)
+			} else {
+				fmt.Fprintf(&buf, "- %s (%s)\n", e.Subject, e.Hash)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// Render returns the changelog in the given format
+func (cl *changelog) Render(format string) ([]byte, error) {
+	switch format {
+	case "", changelogMarkdown:
+		return cl.Markdown(), nil
+	case changelogJSON:
+		return json.MarshalIndent(cl, "", "  ")
+	}
+	return nil, validateChangelogFormat(format)
+}
+
+// parseChangelogRange parses <from>..<to>.  Either may be empty to use the
+// default.  A single ref is the from.
+func parseChangelogRange(rng string) (from, to string) {
+	pp := strings.SplitN(rng, "..", 2)
+	from = pp[0]
+	if len(pp) == 2 {
+		to = pp[1]
+	}
+	return from, to
+}
+
+// Changelog returns the changelog of commits reachable from to but not from.
+// from defaults to the latest tag and to defaults to HEAD.
+func (gt *gitVersion) Changelog(from, to string) (*changelog, error) {
+	if gt.r == nil || gt.head == nil {
+		return nil, fmt.Errorf("not a git repository")
+	}
+	if from == "" && gt.latestTag != nil {
+		from = gt.latestTag.Name().Short()
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+
+	toHash, err := gt.resolveCommit(to)
+	if err != nil {
+		return nil, err
+	}
+	var fromHash plumbing.Hash
+	if from != "" {
+		if fromHash, err = gt.resolveCommit(from); err != nil {
+			return nil, err
+		}
+	}
+	commits, err := gt.commitsBetween(fromHash, toHash, false)
+	if err != nil {
+		return nil, err
+	}
+	// newest first regardless of the traversal order
+	sort.SliceStable(commits, func(i, j int) bool {
+		return commits[i].Committer.When.After(commits[j].Committer.When)
+	})
+
+	cl := newChangelog(commits)
+	cl.From, cl.To = from, to
+	cl.Version = to
+	if to == "HEAD" {
+		if cl.Version = gt.NextVersion(); cl.Version == "" {
+			cl.Version = gt.Version()
+		}
+	}
+	return cl, nil
+}
+
+// resolveCommit returns the commit of a hash, branch, tag or HEAD
+func (gt *gitVersion) resolveCommit(rev string) (plumbing.Hash, error) {
+	if len(rev) == 40 {
+		h := plumbing.NewHash(rev)
+		if _, err := gt.r.CommitObject(h); err == nil {
+			return h, nil
+		}
+	}
+
+	for _, name := range []string{rev, "refs/tags/" + rev, "refs/heads/" + rev, "refs/remotes/" + rev} {
+		ref, err := storer.ResolveReference(gt.r.Storer, plumbing.ReferenceName(name))
+		if err != nil {
+			continue
+		}
+		obj, err := gt.r.Object(plumbing.AnyObject, ref.Hash())
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o.Hash, nil
+		case *object.Tag:
+			c, err := o.Commit()
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			return c.Hash, nil
+		}
+	}
+	if len(rev) >= 4 && len(rev) < 40 && isHex(rev) {
+		return gt.resolveShortHash(rev)
+	}
+	return plumbing.ZeroHash, fmt.Errorf("unknown revision: %s", rev)
+}
+
+// resolveShortHash returns the only commit with the hash prefix
+func (gt *gitVersion) resolveShortHash(prefix string) (plumbing.Hash, error) {
+	iter, err := gt.r.CommitObjects()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer iter.Close()
+
+	var found []plumbing.Hash
+	err = iter.ForEach(func(c *object.Commit) error {
+		if strings.HasPrefix(c.Hash.String(), prefix) {
+			found = append(found, c.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	switch len(found) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("unknown revision: %s", prefix)
+	case 1:
+		return found[0], nil
+	}
+	return plumbing.ZeroHash, fmt.Errorf("ambiguous revision: %s", prefix)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeChangelog writes the changelog of the latest tag to HEAD into the
+// context if configured.
+func (mc *MoldConfig) writeChangelog() error {
+	cc := mc.Changelog
+	if cc.File == "" {
+		return nil
+	}
+	cl, err := mc.gitVersion.Changelog("", "")
+	if err != nil {
+		return err
+	}
+	b, err := cl.Render(cc.Format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(mc.Context, cc.File), b, 0644)
+}
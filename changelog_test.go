@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_gitVersion_Changelog(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+
+	tr.commit("feat: before the tag")
+	tr.tag("v1.0.0", tr.commit("chore: release"))
+	fix := tr.commit("fix(api): handle nil")
+	tr.commit("feat: add thing\n\nBREAKING CHANGE: removed other thing")
+	tr.commit("update readme")
+
+	cl, err := tr.version().Changelog("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.From != "v1.0.0" || cl.To != "HEAD" || cl.Version != "2.0.0" {
+		t.Fatal("wrong range", cl.From, cl.To, cl.Version)
+	}
+
+	md := string(cl.Markdown())
+	for _, s := range []string{"## 2.0.0", "### Breaking Changes", "### Features", "- add thing",
+		"### Bug Fixes", "- **api:** handle nil", "### Other", "- update readme"} {
+		if !strings.Contains(md, s) {
+			t.Errorf("missing '%s' in:\n%s", s, md)
+		}
+	}
+	if strings.Contains(md, "before the tag") {
+		t.Error("commits before the tag should not be included")
+	}
+	if strings.Index(md, "Breaking") > strings.Index(md, "Features") {
+		t.Error("breaking changes should be first")
+	}
+
+	b, err := cl.Render(changelogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out changelog
+	if err = json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Sections) != 4 {
+		t.Fatal("wrong sections", string(b))
+	}
+
+	// explicit range
+	if cl, err = tr.version().Changelog("v1.0.0", fix.String()); err != nil {
+		t.Fatal(err)
+	}
+	if cl.Version != fix.String() || len(cl.Sections) != 1 || cl.Sections[0].Type != "fix" {
+		t.Fatal("wrong changelog", string(cl.Markdown()))
+	}
+	if _, err = tr.version().Changelog("nope", ""); err == nil {
+		t.Fatal("should fail on unknown revision")
+	}
+}
+
+func Test_parseChangelogRange(t *testing.T) {
+	if f, to := parseChangelogRange("v1.0.0..main"); f != "v1.0.0" || to != "main" {
+		t.Fatal(f, to)
+	}
+	if f, to := parseChangelogRange("v1.0.0"); f != "v1.0.0" || to != "" {
+		t.Fatal(f, to)
+	}
+	if f, to := parseChangelogRange(""); f != "" || to != "" {
+		t.Fatal(f, to)
+	}
+}
+
+func Test_ChangelogConfig_parse(t *testing.T) {
+	cc := ChangelogConfig{File: "dist/changes.json"}
+	if err := cc.parse(); err != nil || cc.Format != changelogJSON {
+		t.Fatal("format should default from the extension", err, cc.Format)
+	}
+	if err := (&ChangelogConfig{File: "../CHANGELOG.md"}).parse(); err == nil {
+		t.Fatal("should fail outside the context")
+	}
+	if err := (&ChangelogConfig{File: "CHANGELOG", Format: "xml"}).parse(); err == nil {
+		t.Fatal("should fail on invalid format")
+	}
+}
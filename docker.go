@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,11 +19,20 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
 )
 
+// max time allowed to determine the daemon api version
+const defaultNegotiateTimeout = 10 * time.Second
+
 // ContainerConfig holds all configs needed to run the docker container
 type ContainerConfig struct {
 	Name      string // name of the running container
@@ -29,6 +40,8 @@ type ContainerConfig struct {
 	Container *container.Config
 	Host      *container.HostConfig
 	Network   *network.NetworkingConfig
+	// image pull policy.  Blank pulls if not present
+	Pull string
 
 	id    string
 	state *types.ContainerState
@@ -57,22 +70,121 @@ func DefaultContainerConfig(imageName string) *ContainerConfig {
 // Docker provides a wrapper to perform rudamentary docker operations
 type Docker struct {
 	cli *client.Client
+	// retries of registry pulls and pushes
+	retry retryPolicy
+}
+
+// DockerClientConfig holds the options used to connect to the docker daemon.
+// Unset values are populated from the standard docker environment variables.
+type DockerClientConfig struct {
+	Host       string // unix://, tcp://, npipe:// or ssh:// uri of the daemon
+	APIVersion string // api version to use.  Negotiated with the daemon if empty
+	TLSVerify  bool   // verify the daemon certificate
+	CertPath   string // directory containing ca.pem, cert.pem and key.pem
+	CACert     string // explicit paths override those found in CertPath
+	Cert       string
+	Key        string
+}
+
+// NewDockerClientConfigFromEnv returns a client config populated from DOCKER_HOST,
+// DOCKER_API_VERSION, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+func NewDockerClientConfigFromEnv() *DockerClientConfig {
+	return &DockerClientConfig{
+		Host:       os.Getenv("DOCKER_HOST"),
+		APIVersion: os.Getenv("DOCKER_API_VERSION"),
+		TLSVerify:  os.Getenv("DOCKER_TLS_VERIFY") != "",
+		CertPath:   os.Getenv("DOCKER_CERT_PATH"),
+	}
+}
+
+// tlsOptions returns the tls options to connect with or nil if tls is not
+// configured
+func (dcc *DockerClientConfig) tlsOptions() *tlsconfig.Options {
+	opts := tlsconfig.Options{
+		CAFile:             dcc.CACert,
+		CertFile:           dcc.Cert,
+		KeyFile:            dcc.Key,
+		InsecureSkipVerify: !dcc.TLSVerify,
+	}
+	if dcc.CertPath != "" {
+		if opts.CAFile == "" {
+			opts.CAFile = filepath.Join(dcc.CertPath, "ca.pem")
+		}
+		if opts.CertFile == "" {
+			opts.CertFile = filepath.Join(dcc.CertPath, "cert.pem")
+		}
+		if opts.KeyFile == "" {
+			opts.KeyFile = filepath.Join(dcc.CertPath, "key.pem")
+		}
+	}
+
+	if opts.CAFile == "" && opts.CertFile == "" && opts.KeyFile == "" && !dcc.TLSVerify {
+		return nil
+	}
+	return &opts
+}
+
+// httpClient returns the http client used to talk to the daemon and the host
+// to pass to the docker client.  A nil client is returned when the docker
+// defaults suffice.
+func (dcc *DockerClientConfig) httpClient() (*http.Client, string, error) {
+	host := dcc.Host
+
+	if strings.HasPrefix(host, "ssh://") {
+		sh, err := parseSSHHost(host)
+		if err != nil {
+			return nil, "", err
+		}
+		tr := &http.Transport{
+			DisableCompression: true,
+			Dial: func(_, _ string) (net.Conn, error) {
+				return sh.Dial()
+			},
+		}
+		// The host is only used to construct the request url. All connections
+		// go through ssh.
+		return &http.Client{Transport: tr}, sshDockerHost, nil
+	}
+
+	opts := dcc.tlsOptions()
+	if opts == nil {
+		return nil, host, nil
+	}
+	tlsc, err := tlsconfig.Client(*opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tr := &http.Transport{TLSClientConfig: tlsc}
+	proto, addr, _, err := client.ParseHost(host)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = sockets.ConfigureTransport(tr, proto, addr); err != nil {
+		return nil, "", err
+	}
+	return &http.Client{Transport: tr}, host, nil
 }
 
 // NewDocker returns a new docker client helper using the given uri.  If uri is
 // not provided it uses the default env. client
 func NewDocker(uri string) (*Docker, error) {
-	var (
-		hcli    *http.Client
-		version = os.Getenv("DOCKER_API_VERSION")
-	)
+	cfg := NewDockerClientConfigFromEnv()
+	if len(uri) > 0 {
+		cfg.Host = uri
+	}
+	return NewDockerWithConfig(cfg)
+}
 
-	if len(uri) == 0 {
+// NewDockerWithConfig returns a new docker client helper using the given client
+// config.  If no api version is specified, it is negotiated with the daemon.
+func NewDockerWithConfig(cfg *DockerClientConfig) (*Docker, error) {
+	if len(cfg.Host) == 0 {
 		if runtime.GOOS == "windows" {
-			uri = windowsDockerURI
+			cfg.Host = windowsDockerURI
 			dockerSockFile = windowsDockerURI
 		} else {
-			uri = linuxDockerURI
+			cfg.Host = linuxDockerURI
 		}
 	}
 
@@ -80,14 +192,48 @@ func NewDocker(uri string) (*Docker, error) {
 		os.Setenv("HOME", "C:/Users/"+os.Getenv("USERNAME"))
 	}
 
-	//if version == "" {
-	//      client.
-	//}
-	cli, err := client.NewClient(uri, version, hcli, nil)
+	hcli, host, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	version := cfg.APIVersion
+	if version == "" {
+		version = client.DefaultVersion
+	}
+
+	cli, err := client.NewClient(host, version, hcli, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &Docker{cli: cli}, nil
+	dkr := &Docker{cli: cli, retry: defaultRetryPolicy()}
+
+	if cfg.APIVersion == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultNegotiateTimeout)
+		dkr.NegotiateAPIVersion(ctx)
+		cancel()
+	}
+	return dkr, nil
+}
+
+// NegotiateAPIVersion downgrades the client api version to that of the daemon
+// if the daemon is older.  The client version is left untouched if the daemon
+// cannot be reached.
+func (dkr *Docker) NegotiateAPIVersion(ctx context.Context) {
+	sv, err := dkr.cli.ServerVersion(ctx)
+	if err != nil || sv.APIVersion == "" {
+		return
+	}
+	if versions.LessThan(sv.APIVersion, dkr.cli.ClientVersion()) {
+		dkr.cli.UpdateClientVersion(sv.APIVersion)
+	}
+}
+
+// SetRetry sets the retries of registry pulls and pushes
+func (dkr *Docker) SetRetry(rc RetryConfig) {
+	if rc.policy.attempts > 0 {
+		dkr.retry = rc.policy
+	}
 }
 
 // Client returns the raw docker client
@@ -96,33 +242,55 @@ func (dkr *Docker) Client() *client.Client {
 }
 
 // ImageAvailableLocally returns true if the image is locally available
-func (dkr *Docker) ImageAvailableLocally(imageName string) bool {
-	if _, _, err := dkr.cli.ImageInspectWithRaw(context.Background(), imageName); err == nil {
+func (dkr *Docker) ImageAvailableLocally(ctx context.Context, imageName string) bool {
+	if _, _, err := dkr.cli.ImageInspectWithRaw(ctx, imageName); err == nil {
 		return true
 	}
 	return false
 }
 
-// StartContainer creates and starts a container with the given config updating
-// the state of the ContainerConfig.  It also pulls the base image if not locally
-// available. This is a non-blocking call.
-func (dkr *Docker) StartContainer(cc *ContainerConfig, wr *Log, prefix string) error {
-	if !dkr.ImageAvailableLocally(cc.Container.Image) {
-		if err := dkr.PullImage(cc.Container.Image, nil, wr, prefix); err != nil {
+// CreateContainer creates a container with the given config without starting it,
+// setting the id of the ContainerConfig.  It also pulls the base image per the
+// pull policy of the config.
+func (dkr *Docker) CreateContainer(ctx context.Context, cc *ContainerConfig, wr *Log, prefix string) error {
+	switch image := cc.Container.Image; cc.Pull {
+	case pullAlways:
+		if err := dkr.PullImage(ctx, image, nil, wr, prefix); err != nil {
 			return err
 		}
+	case pullNever:
+		if !dkr.ImageAvailableLocally(ctx, image) {
+			return fmt.Errorf("image not available locally with pull policy never: %s", image)
+		}
+	default:
+		if !dkr.ImageAvailableLocally(ctx, image) {
+			if err := dkr.PullImage(ctx, image, nil, wr, prefix); err != nil {
+				return err
+			}
+		}
 	}
 
-	c, err := dkr.cli.ContainerCreate(context.Background(), cc.Container, cc.Host, cc.Network, cc.Name)
+	c, err := dkr.cli.ContainerCreate(ctx, cc.Container, cc.Host, cc.Network, cc.Name)
 	if err != nil {
 		return err
 	}
 	cc.id = c.ID
+	return nil
+}
+
+// StartContainer creates and starts a container with the given config updating
+// the state of the ContainerConfig.  It also pulls the base image if not locally
+// available. This is a non-blocking call.
+func (dkr *Docker) StartContainer(ctx context.Context, cc *ContainerConfig, wr *Log, prefix string) error {
+	err := dkr.CreateContainer(ctx, cc, wr, prefix)
+	if err != nil {
+		return err
+	}
 
-	if err = dkr.cli.ContainerStart(context.Background(), cc.id, types.ContainerStartOptions{}); err == nil {
+	if err = dkr.cli.ContainerStart(ctx, cc.id, types.ContainerStartOptions{}); err == nil {
 
 		var cont types.ContainerJSON
-		if cont, err = dkr.cli.ContainerInspect(context.Background(), cc.id); err == nil {
+		if cont, err = dkr.cli.ContainerInspect(ctx, cc.id); err == nil {
 			cc.state = cont.State
 			if len(cc.Name) == 0 {
 				cc.Name = cont.Name[1:]
@@ -133,20 +301,20 @@ func (dkr *Docker) StartContainer(cc *ContainerConfig, wr *Log, prefix string) e
 }
 
 // StopContainer stops a container
-func (dkr *Docker) StopContainer(containerID string, timeout time.Duration) error {
-	return dkr.cli.ContainerStop(context.Background(), containerID, &timeout)
+func (dkr *Docker) StopContainer(ctx context.Context, containerID string, timeout time.Duration) error {
+	return dkr.cli.ContainerStop(ctx, containerID, &timeout)
 }
 
 // TailLogs tail container logs to the given writer
 // Attach stdout and stderr of the container to stdout
-func (dkr *Docker) TailLogs(containerID string, wr io.Writer, prefix string) error {
+func (dkr *Docker) TailLogs(ctx context.Context, containerID string, wr io.Writer, prefix string) error {
 	opts := types.ContainerLogsOptions{
 		ShowStderr: true,
 		ShowStdout: true,
 		Follow:     true,
 		Timestamps: true,
 	}
-	r, err := dkr.cli.ContainerLogs(context.Background(), containerID, opts)
+	r, err := dkr.cli.ContainerLogs(ctx, containerID, opts)
 	if err != nil {
 		return err
 	}
@@ -175,38 +343,61 @@ func (dkr *Docker) TailLogs(containerID string, wr io.Writer, prefix string) err
 }
 
 // RemoveContainer removes a container
-func (dkr *Docker) RemoveContainer(containerID string, force bool) error {
+func (dkr *Docker) RemoveContainer(ctx context.Context, containerID string, force bool) error {
 	options := types.ContainerRemoveOptions{Force: force}
-	return dkr.cli.ContainerRemove(context.Background(), containerID, options)
+	return dkr.cli.ContainerRemove(ctx, containerID, options)
+}
+
+// CopyToContainer extracts the tar archive into the path in the container.
+func (dkr *Docker) CopyToContainer(ctx context.Context, containerID, path string, content io.Reader) error {
+	return dkr.cli.CopyToContainer(ctx, containerID, path, content, types.CopyToContainerOptions{})
+}
+
+// CopyFromContainer returns a tar archive of the path in the container.  The
+// caller must close the reader.
+func (dkr *Docker) CopyFromContainer(ctx context.Context, containerID, path string) (io.ReadCloser, error) {
+	rc, _, err := dkr.cli.CopyFromContainer(ctx, containerID, path)
+	return rc, err
+}
+
+// CreateVolume creates a named volume with the given labels
+func (dkr *Docker) CreateVolume(ctx context.Context, name string, labels map[string]string) error {
+	_, err := dkr.cli.VolumeCreate(ctx, volume.VolumesCreateBody{Name: name, Labels: labels})
+	return err
+}
+
+// RemoveVolume removes a named volume from the host
+func (dkr *Docker) RemoveVolume(ctx context.Context, name string, force bool) error {
+	return dkr.cli.VolumeRemove(ctx, name, force)
 }
 
-// BuildImageOfContainer creates an image of a container
-func (dkr *Docker) BuildImageOfContainer(containerID string, reference string) error {
+// BuildImageOfContainer creates an image of a container applying the labels
+func (dkr *Docker) BuildImageOfContainer(ctx context.Context, containerID string, reference string, labels map[string]string) error {
 	options := types.ContainerCommitOptions{
 		Reference: reference,
 	}
-	_, err := dkr.cli.ContainerCommit(context.Background(), containerID, options)
+	for k, v := range labels {
+		options.Changes = append(options.Changes, fmt.Sprintf("LABEL %q=%q", k, v))
+	}
+	_, err := dkr.cli.ContainerCommit(ctx, containerID, options)
 	return err
 }
 
-// BuildImageAsync builds a docker images based on the config and writes the log out
-// to the the specified Writer.  This is an async call.
-func (dkr *Docker) BuildImageAsync(ic *ImageConfig, logWriter io.Writer, prefix string, done chan bool) error {
-	bldCxt, err := tarDirectory(ic.Context)
-	if err != nil {
-		return err
-	}
+// BuildImageAsync builds a docker images based on the config using the supplied
+// tar archive as the build context and writes the log out to the the specified
+// Writer.  The build context is closed once sent.  This is an async call.
+func (dkr *Docker) BuildImageAsync(ctx context.Context, ic *ImageConfig, bldCxt io.ReadCloser, logWriter io.Writer, prefix string, done chan bool) error {
+	defer bldCxt.Close()
+
 	opts := types.ImageBuildOptions{
 		Dockerfile: ic.Dockerfile,
-		Tags:       ic.DefaultRegistryPaths(),
+		Tags:       ic.BuildTags(),
 		Remove:     true, // remove intermediate images
 		NoCache:    !ic.CachedBuild,
+		CacheFrom:  ic.cacheFrom,
 	}
 
-	rps := ic.CustomRegistryPaths()
-	opts.Tags = append(opts.Tags, rps...)
-
-	rsp, err := dkr.cli.ImageBuild(context.Background(), bldCxt, opts)
+	rsp, err := dkr.cli.ImageBuild(ctx, bldCxt, opts)
 	if err != nil {
 		return err
 	}
@@ -252,20 +443,84 @@ func (dkr *Docker) BuildImageAsync(ic *ImageConfig, logWriter io.Writer, prefix
 	return nil
 }
 
+// ListImages returns the images with the given label i.e. key or key=value
+func (dkr *Docker) ListImages(ctx context.Context, label string) ([]types.ImageSummary, error) {
+	args := filters.NewArgs()
+	args.Add("label", label)
+	return dkr.cli.ImageList(ctx, types.ImageListOptions{Filters: args})
+}
+
+// TagImage tags the local image with the reference
+func (dkr *Docker) TagImage(ctx context.Context, image, reference string) error {
+	return dkr.cli.ImageTag(ctx, image, reference)
+}
+
+// ImageRepoDigests returns the repository digests of the local image i.e.
+// name@sha256:...  These are only known once pushed or pulled.
+func (dkr *Docker) ImageRepoDigests(ctx context.Context, image string) ([]string, error) {
+	insp, _, err := dkr.cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	return insp.RepoDigests, nil
+}
+
+// SaveImages returns a tar archive of the images as docker save does
+func (dkr *Docker) SaveImages(ctx context.Context, refs []string) (io.ReadCloser, error) {
+	return dkr.cli.ImageSave(ctx, refs)
+}
+
+// RegistryInsecure returns whether the daemon allows plain http, or unverified
+// https, to the registry i.e. it is in its insecure-registries.  Registries on
+// the loopback network are by default.
+func (dkr *Docker) RegistryInsecure(ctx context.Context, registry string) (bool, error) {
+	info, err := dkr.cli.Info(ctx)
+	if err != nil {
+		return false, err
+	}
+	return daemonRegistryInsecure(info.RegistryConfig, registry), nil
+}
+
+func daemonRegistryInsecure(sc *registrytypes.ServiceConfig, registry string) bool {
+	if sc == nil {
+		return false
+	}
+	if ii, ok := sc.IndexConfigs[registry]; ok {
+		return !ii.Secure
+	}
+
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		for _, cidr := range sc.InsecureRegistryCIDRs {
+			if (*net.IPNet)(cidr).Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // RemoveImage locally from the host
-func (dkr *Docker) RemoveImage(imageID string, force bool, cleanUp bool) error {
+func (dkr *Docker) RemoveImage(ctx context.Context, imageID string, force bool, cleanUp bool) error {
 	options := types.ImageRemoveOptions{Force: force}
 	if cleanUp {
 		options.PruneChildren = true
 	}
-	_, err := dkr.cli.ImageRemove(context.Background(), imageID, options)
+	_, err := dkr.cli.ImageRemove(ctx, imageID, options)
 	return err
 }
 
 // CreateNetwork creates a bridge network
-func (dkr *Docker) CreateNetwork(name string) (string, error) {
+func (dkr *Docker) CreateNetwork(ctx context.Context, name string) (string, error) {
 	opts := types.NetworkCreate{Driver: "bridge", CheckDuplicate: false}
-	rsp, err := dkr.cli.NetworkCreate(context.Background(), name, opts)
+	rsp, err := dkr.cli.NetworkCreate(ctx, name, opts)
 	if err != nil {
 		return "", err
 	}
@@ -273,8 +528,8 @@ func (dkr *Docker) CreateNetwork(name string) (string, error) {
 }
 
 // RemoveNetwork removes the network from the host
-func (dkr *Docker) RemoveNetwork(networkID string) error {
-	return dkr.cli.NetworkRemove(context.Background(), networkID)
+func (dkr *Docker) RemoveNetwork(ctx context.Context, networkID string) error {
+	return dkr.cli.NetworkRemove(ctx, networkID)
 }
 
 func (dkr *Docker) GetAuthBase64(authConfig types.AuthConfig) (string, error) {
@@ -286,57 +541,144 @@ func (dkr *Docker) GetAuthBase64(authConfig types.AuthConfig) (string, error) {
 }
 
 // PushImage pushes a local docker image up to a registry
-func (dkr *Docker) PushImage(imageRef string, authCfg *types.AuthConfig, logWriter io.Writer, prefix string) error {
+func (dkr *Docker) PushImage(ctx context.Context, imageRef string, authCfg *types.AuthConfig, logWriter io.Writer, prefix string) error {
+	_, err := dkr.PushImageDigest(ctx, imageRef, authCfg, logWriter, prefix)
+	return err
+}
+
+// PushImageDigest pushes a local docker image up to a registry returning the
+// digest of the pushed manifest i.e. sha256:...
+func (dkr *Docker) PushImageDigest(ctx context.Context, imageRef string, authCfg *types.AuthConfig, logWriter io.Writer, prefix string) (string, error) {
 	opts := types.ImagePushOptions{}
 	if authCfg != nil {
 		if a, err := dkr.GetAuthBase64(*authCfg); err != nil {
 			logWriter.Write([]byte(fmt.Sprintf("%s Error: %s\n", prefix, err.Error())))
-			return err
+			return "", err
 		} else {
 			opts.RegistryAuth = a
 		}
 	}
 
 	logWriter.Write([]byte(prefix + " Publishing image: " + imageRef + "\n"))
-	rsp, err := dkr.cli.ImagePush(context.Background(), imageRef, opts)
-	if err != nil {
+	var digest string
+	err := dkr.retry.do(ctx, logWriter, prefix, "Push "+imageRef, func() error {
+		rsp, err := dkr.cli.ImagePush(ctx, imageRef, opts)
+		if err != nil {
+			return err
+		}
+		defer rsp.Close()
+
+		digest, err = readPushStream(rsp, logWriter, prefix)
 		return err
+	})
+	return digest, err
+}
+
+// pushMessage is a message of the json stream of a push
+type pushMessage struct {
+	Status         string
+	ID             string
+	ProgressDetail imgPullProgressDetail
+	Error          string
+	// {"Tag":"latest","Digest":"sha256:...","Size":1234}
+	Aux *struct {
+		Digest string
 	}
-	defer rsp.Close()
-	buf := bufio.NewReader(rsp)
+}
+
+// pushProgress reports the progress of each layer of a push.  The progress of
+// a layer is written at most once per quarter of its size.
+type pushProgress struct {
+	wr       io.Writer
+	prefix   string
+	quarters map[string]int // last reported quarter of each layer
+	sizes    map[string]int
+
+	pushed   int
+	existing int
+}
+
+func (pp *pushProgress) layer(m *pushMessage) {
+	switch {
+	case m.Status == "Preparing" || m.Status == "Waiting":
+		return
+
+	case m.Status == "Pushing":
+		if m.ProgressDetail.Total <= 0 {
+			return
+		}
+		pp.sizes[m.ID] = m.ProgressDetail.Total
+		// completion is reported by pushed
+		q := int(m.ProgressDetail.Percent()) / 25
+		if q == 0 || q >= 4 || q <= pp.quarters[m.ID] {
+			return
+		}
+		pp.quarters[m.ID] = q
+		pp.wr.Write([]byte(fmt.Sprintf("%s Pushing: %s %d%% of %d bytes\n", pp.prefix, m.ID, q*25, m.ProgressDetail.Total)))
+		return
+
+	case m.Status == "Pushed":
+		pp.pushed++
+		if size, ok := pp.sizes[m.ID]; ok {
+			pp.wr.Write([]byte(fmt.Sprintf("%s Pushed: %s %d bytes\n", pp.prefix, m.ID, size)))
+			return
+		}
 
+	case m.Status == "Layer already exists" || strings.HasPrefix(m.Status, "Mounted from"):
+		pp.existing++
+	}
+	pp.wr.Write([]byte(fmt.Sprintf("%s %s: %s\n", pp.prefix, m.Status, m.ID)))
+}
+
+// readPushStream writes the progress of a push from its json stream returning
+// the digest of the pushed manifest
+func readPushStream(rd io.Reader, logWriter io.Writer, prefix string) (string, error) {
+	var (
+		buf    = bufio.NewReader(rd)
+		pp     = &pushProgress{wr: logWriter, prefix: prefix, quarters: map[string]int{}, sizes: map[string]int{}}
+		digest string
+	)
 	for {
-		var b []byte
-		if b, err = buf.ReadBytes('\n'); err != nil {
+		b, err := buf.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(b) == 0) {
 			if err == io.EOF {
 				err = nil
 			}
-			break
+			if err == nil && (pp.pushed > 0 || pp.existing > 0) {
+				logWriter.Write([]byte(fmt.Sprintf("%s Layers: %d pushed, %d existing\n", prefix, pp.pushed, pp.existing)))
+			}
+			return digest, err
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
 		}
 
-		var m map[string]interface{}
-		if err = json.Unmarshal(b, &m); err != nil {
-			break
+		var m pushMessage
+		if json.Unmarshal(b, &m) != nil {
+			// i.e. a proxy in front of the daemon
+			logWriter.Write([]byte(prefix + " " + string(b) + "\n"))
+			continue
 		}
 
-		if st, ok := m["status"]; ok {
-			status := st.(string)
-			logWriter.Write([]byte(prefix + " " + status + "\n"))
-		} else if er, ok := m["error"]; ok {
-			errStr := er.(string)
-			logWriter.Write([]byte(prefix + " " + errStr + "\n"))
-			err = fmt.Errorf(errStr)
-			break
-		} else {
-			logWriter.Write(append([]byte(prefix), b...))
+		switch {
+		case m.Error != "":
+			logWriter.Write([]byte(prefix + " " + m.Error + "\n"))
+			return digest, fmt.Errorf(m.Error)
+		case m.Aux != nil:
+			if m.Aux.Digest != "" {
+				digest = m.Aux.Digest
+			}
+		case m.ID != "":
+			pp.layer(&m)
+		case m.Status != "":
+			logWriter.Write([]byte(prefix + " " + m.Status + "\n"))
 		}
 	}
-
-	return err
 }
 
 // PullImage pulls a remote image from a registry down locally
-func (dkr *Docker) PullImage(imageRef string, authCfg *types.AuthConfig, logWriter io.Writer, prefix string) error {
+func (dkr *Docker) PullImage(ctx context.Context, imageRef string, authCfg *types.AuthConfig, logWriter io.Writer, prefix string) error {
 	opts := types.ImagePullOptions{}
 	if authCfg != nil {
 		if a, err := dkr.GetAuthBase64(*authCfg); err != nil {
@@ -346,7 +688,18 @@ func (dkr *Docker) PullImage(imageRef string, authCfg *types.AuthConfig, logWrit
 			opts.RegistryAuth = a
 		}
 	}
-	rsp, err := dkr.cli.ImagePull(context.Background(), imageRef, opts)
+
+	err := dkr.retry.do(ctx, logWriter, prefix, "Pull "+imageRef, func() error {
+		return dkr.pullImage(ctx, imageRef, opts, logWriter, prefix)
+	})
+	if err == nil {
+		logWriter.Write([]byte(fmt.Sprintf("%s Pulled image: %s\n", prefix, imageRef)))
+	}
+	return err
+}
+
+func (dkr *Docker) pullImage(ctx context.Context, imageRef string, opts types.ImagePullOptions, logWriter io.Writer, prefix string) error {
+	rsp, err := dkr.cli.ImagePull(ctx, imageRef, opts)
 	if err != nil {
 		return err
 	}
@@ -362,11 +715,19 @@ func (dkr *Docker) PullImage(imageRef string, authCfg *types.AuthConfig, logWrit
 			}
 			break
 		}
-		b = b[:len(b)-1]
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
+		}
 
 		var m imgPullProgress
-		if err = json.Unmarshal(b, &m); err != nil {
-			break
+		if json.Unmarshal(b, &m) != nil {
+			logWriter.Write([]byte(prefix + " " + string(b) + "\n"))
+			continue
+		}
+		if m.Error != "" {
+			logWriter.Write([]byte(prefix + " " + m.Error + "\n"))
+			return fmt.Errorf(m.Error)
 		}
 
 		if m.ProgressDetail.Current == m.ProgressDetail.Total && m.ProgressDetail.Total > 0 {
@@ -374,10 +735,6 @@ func (dkr *Docker) PullImage(imageRef string, authCfg *types.AuthConfig, logWrit
 		}
 
 	}
-	if err == nil {
-		logWriter.Write([]byte(fmt.Sprintf("%s Pulled image: %s\n", prefix, imageRef)))
-	}
-
 	return err
 }
 
@@ -395,6 +752,7 @@ type imgPullProgress struct {
 	Status         string
 	ID             string
 	ProgressDetail imgPullProgressDetail
+	Error          string
 }
 
 // DockerAuthConfig contains the auth config to perform registry operations
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// placeholder host used to construct request urls when tunneling over ssh.
+const sshDockerHost = "tcp://docker"
+
+// sshHost is a remote docker daemon reachable over ssh i.e. ssh://user@host:port
+type sshHost struct {
+	User string
+	Host string
+	Port string
+}
+
+func parseSSHHost(uri string) (*sshHost, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" {
+		return nil, fmt.Errorf("not an ssh uri: %s", uri)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host specified: %s", uri)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("path not supported in ssh uri: %s", uri)
+	}
+
+	sh := &sshHost{Host: u.Hostname(), Port: u.Port()}
+	if u.User != nil {
+		sh.User = u.User.Username()
+	}
+	return sh, nil
+}
+
+// args returns the ssh command line arguments to reach the daemon.  This requires
+// docker 18.09 or later on the remote host.
+func (sh *sshHost) args() []string {
+	var args []string
+	if sh.User != "" {
+		args = append(args, "-l", sh.User)
+	}
+	if sh.Port != "" {
+		args = append(args, "-p", sh.Port)
+	}
+	return append(args, "--", sh.Host, "docker", "system", "dial-stdio")
+}
+
+// Dial starts an ssh process whose stdin/stdout are connected to the remote
+// daemon socket.
+func (sh *sshHost) Dial() (net.Conn, error) {
+	cmd := exec.Command("ssh", sh.args()...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd: cmd, r: stdout, w: stdin, host: sh.Host}, nil
+}
+
+// sshConn is a net.Conn over the stdio of an ssh process
+type sshConn struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	host string
+}
+
+func (sc *sshConn) Read(b []byte) (int, error)  { return sc.r.Read(b) }
+func (sc *sshConn) Write(b []byte) (int, error) { return sc.w.Write(b) }
+
+func (sc *sshConn) Close() error {
+	err := sc.w.Close()
+	err = mergeErrors(err, sc.r.Close())
+	if sc.cmd.Process != nil {
+		sc.cmd.Process.Kill()
+	}
+	sc.cmd.Wait()
+	return err
+}
+
+func (sc *sshConn) LocalAddr() net.Addr  { return sshAddr("local") }
+func (sc *sshConn) RemoteAddr() net.Addr { return sshAddr(sc.host) }
+
+// Deadlines are not supported on process pipes
+func (sc *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (sc *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sc *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
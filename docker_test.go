@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
 )
 
 func Test_Docker(t *testing.T) {
@@ -39,7 +43,7 @@ func Test_Docker_StartContainer(t *testing.T) {
 	}
 
 	cc := DefaultContainerConfig("test")
-	err = d.StartContainer(cc, nil, "prefix")
+	err = d.StartContainer(context.Background(), cc, nil, "prefix")
 	if err == nil {
 		t.Fatal("should be pull error")
 	}
@@ -52,20 +56,20 @@ func Test_Docker_StartContainer(t *testing.T) {
 
 func Test_Docker_PullImage(t *testing.T) {
 	d, _ := NewDocker("")
-	if err := d.PullImage("busybox:latest", nil, os.Stdout, ""); err != nil {
+	if err := d.PullImage(context.Background(), "busybox:latest", nil, os.Stdout, ""); err != nil {
 		t.Fatal(err)
 	}
 
-	d.RemoveImage("busybox:latest", true, false)
+	d.RemoveImage(context.Background(), "busybox:latest", true, false)
 
-	if err := d.PullImage("nosuchrepo:latest", nil, os.Stdout, ""); err == nil {
+	if err := d.PullImage(context.Background(), "nosuchrepo:latest", nil, os.Stdout, ""); err == nil {
 		t.Fatal("should be reported when failing to pull an image")
 	}
 }
 
 func Test_ImageAvailableLocally(t *testing.T) {
 	d, _ := NewDocker("")
-	if exists := d.ImageAvailableLocally("secretImage"); exists == true {
+	if exists := d.ImageAvailableLocally(context.Background(), "secretImage"); exists == true {
 		t.Fatal("should return false")
 	}
 }
@@ -99,7 +103,7 @@ func TestNewDocker(t *testing.T) {
 
 func Test_Docker_BuildImageOfContainer(t *testing.T) {
 	d, _ := NewDocker("unix:///var/run/docker.sock")
-	if err := d.BuildImageOfContainer("", ""); err == nil {
+	if err := d.BuildImageOfContainer(context.Background(), "", "", nil); err == nil {
 		t.Fatal("expected error")
 	}
 }
@@ -114,12 +118,12 @@ func Test_GetAuthBase64(t *testing.T) {
 func Test_PushImage(t *testing.T) {
 	d, _ := NewDocker("unix:///var/run/docker.sock")
 	a := &types.AuthConfig{}
-	if err := d.PushImage("rp", a, os.Stdout, fmt.Sprintf("[publish/%s]", "rp")); err == nil {
+	if err := d.PushImage(context.Background(), "rp", a, os.Stdout, fmt.Sprintf("[publish/%s]", "rp")); err == nil {
 		t.Fatal("should be auth error")
 	}
 
 	authConf := &types.AuthConfig{Username: "Unknown"}
-	if err := d.PushImage("rp", authConf, os.Stdout, fmt.Sprintf("[publish/%s]", "rp")); err == nil {
+	if err := d.PushImage(context.Background(), "rp", authConf, os.Stdout, fmt.Sprintf("[publish/%s]", "rp")); err == nil {
 		t.Fatal("should be push error")
 	}
 }
@@ -142,3 +146,129 @@ func Test_DockerHubAuth(t *testing.T) {
 		t.Error("docker hub auth config should be not nil")
 	}
 }
+
+func Test_parseSSHHost(t *testing.T) {
+	sh, err := parseSSHHost("ssh://builder@build01.example.com:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.User != "builder" || sh.Host != "build01.example.com" || sh.Port != "2222" {
+		t.Fatalf("bad parse: %+v", sh)
+	}
+	args := sh.args()
+	if args[len(args)-1] != "dial-stdio" {
+		t.Fatalf("bad args: %v", args)
+	}
+
+	if _, err = parseSSHHost("ssh:///foo"); err == nil {
+		t.Fatal("should fail with no host")
+	}
+	if _, err = parseSSHHost("tcp://foo:2375"); err == nil {
+		t.Fatal("should fail with non ssh scheme")
+	}
+}
+
+func Test_DockerClientConfig_tlsOptions(t *testing.T) {
+	cfg := &DockerClientConfig{Host: "tcp://127.0.0.1:2376"}
+	if cfg.tlsOptions() != nil {
+		t.Fatal("tls should not be configured")
+	}
+
+	cfg.CertPath = "/certs"
+	cfg.Key = "/other/key.pem"
+	opts := cfg.tlsOptions()
+	if opts == nil {
+		t.Fatal("tls should be configured")
+	}
+	if opts.CAFile != "/certs/ca.pem" || opts.CertFile != "/certs/cert.pem" || opts.KeyFile != "/other/key.pem" {
+		t.Fatalf("bad tls options: %+v", opts)
+	}
+	if !opts.InsecureSkipVerify {
+		t.Fatal("verify should be off")
+	}
+
+	cfg.CertPath = "/does/not/exist"
+	cfg.Key = ""
+	if _, err := NewDockerWithConfig(cfg); err == nil {
+		t.Fatal("should fail loading certs")
+	}
+}
+
+func Test_readPushStream(t *testing.T) {
+	stream := `{"status":"The push refers to a repository [localhost:5000/app]"}
+{"status":"Preparing","progressDetail":{},"id":"aaa"}
+{"status":"Preparing","progressDetail":{},"id":"bbb"}
+{"status":"Layer already exists","progressDetail":{},"id":"bbb"}
+{"status":"Pushing","progressDetail":{"current":100,"total":1000},"id":"aaa"}
+{"status":"Pushing","progressDetail":{"current":300,"total":1000},"id":"aaa"}
+{"status":"Pushing","progressDetail":{"current":400,"total":1000},"id":"aaa"}
+{"status":"Pushing","progressDetail":{"current":1000,"total":1000},"id":"aaa"}
+{"status":"Pushed","progressDetail":{},"id":"aaa"}
+{"status":"latest: digest: sha256:abc size: 527"}
+{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:abc","Size":527}}
+`
+	var buf bytes.Buffer
+	digest, err := readPushStream(strings.NewReader(stream), &buf, "[p]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:abc" {
+		t.Fatal("wrong digest", digest)
+	}
+	want := `[p] The push refers to a repository [localhost:5000/app]
+[p] Layer already exists: bbb
+[p] Pushing: aaa 25% of 1000 bytes
+[p] Pushed: aaa 1000 bytes
+[p] latest: digest: sha256:abc size: 527
+[p] Layers: 1 pushed, 1 existing
+`
+	if buf.String() != want {
+		t.Fatalf("\n%s", buf.String())
+	}
+
+	stream = `{"status":"Preparing","progressDetail":{},"id":"aaa"}
+{"errorDetail":{"message":"denied"},"error":"denied"}
+`
+	if _, err = readPushStream(strings.NewReader(stream), &buf, "[p]"); err == nil || err.Error() != "denied" {
+		t.Fatal("should fail", err)
+	}
+}
+
+func Test_daemonRegistryInsecure(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	sc := &registrytypes.ServiceConfig{
+		InsecureRegistryCIDRs: []*registrytypes.NetIPNet{(*registrytypes.NetIPNet)(loopback)},
+		IndexConfigs: map[string]*registrytypes.IndexInfo{
+			"docker.io":         {Name: "docker.io", Secure: true},
+			"registry.dev:5000": {Name: "registry.dev:5000", Secure: false},
+		},
+	}
+	for reg, want := range map[string]bool{
+		"docker.io":         false,
+		"registry.dev:5000": true,
+		"127.0.0.1:5000":    true,
+		"localhost:5000":    true,
+		"10.0.0.1:5000":     false,
+	} {
+		if have := daemonRegistryInsecure(sc, reg); have != want {
+			t.Errorf("%s: have=%v want=%v", reg, have, want)
+		}
+	}
+	if daemonRegistryInsecure(nil, "localhost:5000") {
+		t.Fatal("should not be insecure without a config")
+	}
+}
+
+func Test_readPushStream_invalidJSON(t *testing.T) {
+	stream := `{"status":"Preparing","progressDetail":{},"id":"aaa"}
+<html>proxy</html>
+{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:abc","Size":527}}`
+	var buf bytes.Buffer
+	digest, err := readPushStream(strings.NewReader(stream), &buf, "[p]")
+	if err != nil || digest != "sha256:abc" {
+		t.Fatal("should skip lines that are not json", digest, err)
+	}
+	if buf.String() != "[p] <html>proxy</html>\n" {
+		t.Fatalf("%q", buf.String())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
@@ -32,22 +33,25 @@ type DockerWorker struct {
 	serviceStates containerStates // service containers
 	buildStates   containerStates // build containers
 	netID         string          // network id to connect all containers to
+	workspace     *workspace      // context volume when not bind mounting
 
 	docker *Docker // docker helper client
 
-	done    chan bool // when all builds are completed
-	abort   chan bool // cancelled channel
-	aborted bool      // whether the worker has begun shutdown
+	done chan bool // when all builds are completed
 
 	log *Log
 	// Auth config for registry operations
 	authCfg *DockerAuthConfig
+	// images pushed by publish with their digests
+	published []publishedImage
+	// changelog and build info written into the context this run
+	wroteContextFiles bool
 }
 
 // NewDockerWorker instantiates a new worker. If no client is provided and env.
 // based client is used.
 func NewDockerWorker(dcli *Docker) (d *DockerWorker, err error) {
-	d = &DockerWorker{docker: dcli, log: &Log{Writer: os.Stdout}, abort: make(chan bool, 1)}
+	d = &DockerWorker{docker: dcli, log: &Log{Writer: os.Stdout}}
 	// set up registry auth. pushes will not happen if failed
 	if d.authCfg, err = readDockerAuthConfig(""); err != nil {
 		log.Println("WRN", err)
@@ -67,6 +71,8 @@ func (dw *DockerWorker) Configure(cfg *MoldConfig) error {
 	defer dw.mu.Unlock()
 
 	dw.buildConfig = cfg
+	dw.wroteContextFiles = false
+	dw.docker.SetRetry(cfg.Retry)
 
 	// Build service container contfigs
 	sc, err := assembleServiceContainers(cfg)
@@ -106,7 +112,12 @@ func (dw *DockerWorker) Configure(cfg *MoldConfig) error {
 	}
 
 	// Build build container configs
-	bc, err := assembleBuildContainers(cfg)
+	dw.workspace = newWorkspace(cfg)
+	var wsVolume string
+	if dw.workspace != nil {
+		wsVolume = dw.workspace.Volume
+	}
+	bc, caches, err := assembleBuildContainers(cfg, wsVolume)
 	if err != nil {
 		return fmt.Errorf("Could not assemble build container: %v", err)
 	}
@@ -120,15 +131,30 @@ func (dw *DockerWorker) Configure(cfg *MoldConfig) error {
 		cs.Name = fmt.Sprintf("%s-%d-%d", dw.buildConfig.Name(), i, time.Now().UnixNano())
 		cs.shortName = shortContainerName(cs.Name)
 		cs.Network = dw.defaultNetConfig()
+		cs.caches = caches[i]
+
+		for _, o := range dw.buildConfig.Build[i].Outputs {
+			out, err := parseBuildOutput(o)
+			if err != nil {
+				return err
+			}
+			cs.outputs = append(cs.outputs, out)
+		}
 
 		if dw.buildConfig.Build[i].Cache {
-			hash, err := getBuildHash(cs.ContainerConfig)
+			hash, err := getBuildHash(cs.ContainerConfig, cfg.Context)
 			if err != nil {
 				return err
 			}
+			if ck := dw.buildConfig.Build[i].CacheKey; ck != nil {
+				if hash, err = getCacheKeyHash(hash, cfg.Context, cs.Container.Env, ck); err != nil {
+					return err
+				}
+			}
 			cs.cache = &cache{
-				Name: fmt.Sprintf("cache-%s", dw.buildConfig.RepoName),
+				Name: cacheImageName(cfg.CacheRegistry, dw.buildConfig.RepoName),
 				Tag:  hash,
+				Step: buildStepName(i, dw.buildConfig.Build[i]),
 			}
 		}
 		dw.buildStates[i] = cs
@@ -158,6 +184,15 @@ func assembleServiceContainers(mc *MoldConfig) ([]*ContainerConfig, error) {
 		cc := DefaultContainerConfig(b.Image)
 		cc.Container.Cmd = b.Commands
 		cc.Host.Binds = b.Volumes
+		cc.Pull = mc.pullPolicy(b)
+
+		exposedPorts, portBindings, err := nat.ParsePortSpecs(b.Ports)
+		if err != nil {
+			return nil, err
+		}
+		cc.Container.ExposedPorts = exposedPorts
+		cc.Host.PortBindings = portBindings
+
 		env, err := b.GetEnvStrings()
 		if err != nil {
 			return nil, err
@@ -169,17 +204,21 @@ func assembleServiceContainers(mc *MoldConfig) ([]*ContainerConfig, error) {
 	return bcs, nil
 }
 
-// assembleBuildContainers assembles container configs from user provided build config
-func assembleBuildContainers(mc *MoldConfig) ([]*ContainerConfig, error) {
+// assembleBuildContainers assembles container configs from user provided build config.
+// If a workspace volume is provided it is mounted in place of the context.  The
+// cache volumes mounted are returned per build step.
+func assembleBuildContainers(mc *MoldConfig, wsVolume string) ([]*ContainerConfig, [][]*cacheVolume, error) {
 	bconts := make([]*ContainerConfig, len(mc.Build))
+	caches := make([][]*cacheVolume, len(mc.Build))
 	for i, b := range mc.Build {
 		cc := DefaultContainerConfig(b.Image)
 		cc.Container.WorkingDir = b.Workdir
 		cc.Host.Binds = b.Volumes
+		cc.Pull = mc.pullPolicy(b)
 
 		exposedPorts, portBindings, err := nat.ParsePortSpecs(b.Ports)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		cc.Container.ExposedPorts = exposedPorts
 		cc.Host.PortBindings = portBindings
@@ -189,17 +228,33 @@ func assembleBuildContainers(mc *MoldConfig) ([]*ContainerConfig, error) {
 
 		env, err := b.GetEnvStrings()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		cc.Container.Env = env
 
-		src := mc.Context
-		if runtime.GOOS == "windows" {
-			src = toDockerWinPath(src)
+		if len(wsVolume) > 0 {
+			cc.Host.Mounts = []mount.Mount{
+				mount.Mount{Target: b.Workdir, Source: wsVolume, Type: mount.TypeVolume},
+			}
+		} else {
+			src := mc.Context
+			if runtime.GOOS == "windows" {
+				src = toDockerWinPath(src)
+			}
+			cc.Host.Mounts = []mount.Mount{
+				mount.Mount{Target: b.Workdir, Source: src, Type: mount.TypeBind},
+			}
 		}
-		cc.Host.Mounts = []mount.Mount{
-			mount.Mount{Target: b.Workdir, Source: src, Type: mount.TypeBind},
+
+		cvs, err := buildCacheVolumes(mc, b)
+		if err != nil {
+			return nil, nil, err
 		}
+		for _, cv := range cvs {
+			cc.Container.Volumes[cv.Path] = struct{}{}
+			cc.Host.Mounts = append(cc.Host.Mounts, cv.Mount())
+		}
+		caches[i] = cvs
 		bconts[i] = cc
 
 		// Mount docker.sock in container if requested.
@@ -209,7 +264,7 @@ func assembleBuildContainers(mc *MoldConfig) ([]*ContainerConfig, error) {
 				mount.Mount{Target: dockerSockFile, Source: dockerSockFile, Type: mount.TypeBind})
 		}
 	}
-	return bconts, nil
+	return bconts, caches, nil
 }
 
 func (dw *DockerWorker) defaultNetConfig() *network.NetworkingConfig {
@@ -223,7 +278,7 @@ func (dw *DockerWorker) defaultNetConfig() *network.NetworkingConfig {
 }
 
 // GenerateArtifacts builds docker images
-func (dw *DockerWorker) GenerateArtifacts(names ...string) error {
+func (dw *DockerWorker) GenerateArtifacts(ctx context.Context, names ...string) error {
 	var ics []ImageConfig
 	if len(names) == 0 {
 		ics = dw.buildConfig.Artifacts.Images
@@ -236,13 +291,17 @@ func (dw *DockerWorker) GenerateArtifacts(names ...string) error {
 			ics = append(ics, *a)
 		}
 	}
+	// the artifacts target runs without setup
+	if err := dw.writeContextFiles("artifacts"); err != nil {
+		return err
+	}
 	var err error
 	for _, ic := range ics {
-		if dw.aborted {
+		if ctx.Err() != nil {
 			return errAborted
 		}
 		dw.log.Write([]byte(fmt.Sprintf("[artifacts/%s] Building\n", ic.Name)))
-		if err = dw.generateArtifact(&ic); err != nil {
+		if err = dw.generateArtifact(ctx, &ic); err != nil {
 			// stop the process without creating other artifacts
 			break
 		}
@@ -251,9 +310,15 @@ func (dw *DockerWorker) GenerateArtifacts(names ...string) error {
 	return err
 }
 
-func (dw *DockerWorker) generateArtifact(ic *ImageConfig) error {
-	dw.done = make(chan bool)
-	err := dw.docker.BuildImageAsync(ic, dw.log, fmt.Sprintf("[artifacts/%s]", ic.Name), dw.done)
+func (dw *DockerWorker) generateArtifact(ctx context.Context, ic *ImageConfig) error {
+	ic.cacheFrom = dw.pullCacheFrom(ctx, ic)
+
+	bldCxt, err := dw.artifactContext(ctx, ic)
+	if err != nil {
+		return err
+	}
+	dw.done = make(chan bool, 1)
+	err = dw.docker.BuildImageAsync(ctx, ic, bldCxt, dw.log, fmt.Sprintf("[artifacts/%s]", ic.Name), dw.done)
 	if err != nil {
 		return err
 	}
@@ -267,18 +332,52 @@ func (dw *DockerWorker) generateArtifact(ic *ImageConfig) error {
 				err = fmt.Errorf("[artifacts] Failed to create image %s", ic.Name)
 			}
 		}
-	case <-dw.abort:
-		dw.RemoveArtifacts()
+	case <-ctx.Done():
 		dw.log.Write([]byte("[artifacts] Aborting...\n"))
+		cctx, cancel := cleanupContext()
+		dw.RemoveArtifacts(cctx)
+		cancel()
+		err = errAborted
 	}
 	return err
 }
 
+// pullCacheFrom pulls the cache sources of the image returning those available
+// locally.  Sources that cannot be pulled, e.g. not yet published, are skipped.
+func (dw *DockerWorker) pullCacheFrom(ctx context.Context, ic *ImageConfig) []string {
+	var (
+		refs   []string
+		prefix = fmt.Sprintf("[artifacts/%s]", ic.Name)
+	)
+	for _, ref := range ic.CacheFromRefs() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !dw.docker.ImageAvailableLocally(ctx, ref) {
+			if dw.buildConfig.Offline {
+				continue
+			}
+			if err := dw.docker.PullImage(ctx, ref, dw.getRegistryAuth(imageRegistry(ref)), dw.log, prefix); err != nil {
+				dw.log.Write([]byte(fmt.Sprintf("%s Cache source not pulled %s: %v\n", prefix, ref, err)))
+				continue
+			}
+			if !dw.docker.ImageAvailableLocally(ctx, ref) {
+				continue
+			}
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) > 0 {
+		dw.log.Write([]byte(fmt.Sprintf("%s Cache from %s\n", prefix, strings.Join(refs, ", "))))
+	}
+	return refs
+}
+
 // RemoveArtifacts removes all local artifacts it as definted in the config
-func (dw *DockerWorker) RemoveArtifacts() error {
+func (dw *DockerWorker) RemoveArtifacts(ctx context.Context) error {
 	var err error
 	for _, a := range dw.buildConfig.Artifacts.Images {
-		err = mergeErrors(err, dw.docker.RemoveImage(a.Name, true, a.CleanUp))
+		err = mergeErrors(err, dw.docker.RemoveImage(ctx, a.Name, true, a.CleanUp))
 	}
 	return err
 }
@@ -315,61 +414,126 @@ func (dw *DockerWorker) getRegistryAuth(registry string) *types.AuthConfig {
 	return auth
 }
 
+// hasAuth returns whether any registry auth is configured
+func (dw *DockerWorker) hasAuth() bool {
+	return dw.authCfg != nil && len(dw.authCfg.Auths) > 0
+}
+
 // Publish the artifact/s based on the config
-func (dw *DockerWorker) Publish(names ...string) error {
-	if dw.authCfg == nil || len(dw.authCfg.Auths) == 0 || dw.buildConfig == nil {
+func (dw *DockerWorker) Publish(ctx context.Context, names ...string) error {
+	if dw.buildConfig == nil || !dw.hasAuth() && !dw.buildConfig.Artifacts.Export.IsSet() && len(dw.buildConfig.Artifacts.Insecure) == 0 {
 		//dw.log.Write([]byte("[publish] Not publishing.  registry auth not specified\n"))
 		return fmt.Errorf("registry auth not specified")
 	}
 
-	if len(names) == 0 {
-		for _, v := range dw.buildConfig.Artifacts.Images {
-			if dw.aborted {
-				return errAborted
-			}
-			auth := dw.getRegistryAuth(v.Registry)
+	arts := &dw.buildConfig.Artifacts
+	refs, err := arts.PublishRefs(dw.buildConfig.BranchTag, names...)
+	if err != nil {
+		return err
+	}
+	export := arts.Export.IsSet() && (len(names) > 0 || arts.exports(dw.buildConfig.BranchTag))
+	if len(refs) == 0 && !export {
+		dw.log.Write([]byte("[publish] Not publishing. Criteria not met.\n"))
+		return nil
+	}
+	registries := make([]string, len(refs))
+	for i, ref := range refs {
+		registries[i] = ref.Registry
+	}
+	if err = dw.checkRegistryAuth(registries...); err != nil {
+		return err
+	}
+	if export {
+		if err = dw.Export(ctx, names...); err != nil {
+			return err
+		}
+	}
+	if err = dw.checkInsecureRegistries(ctx, refs); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			return errAborted
+		}
+		prefix := fmt.Sprintf("[publish/%s]", ref.Path)
+		auth := dw.getRegistryAuth(ref.Registry)
+		digest, err := dw.docker.PushImageDigest(ctx, ref.Path, auth, os.Stdout, prefix)
+		if err != nil {
+			return err
+		}
+		pi := publishedImage{Ref: ref.Path, Digest: digest}
+		dw.published = append(dw.published, pi)
+		dw.log.Write([]byte(fmt.Sprintf("%s Digest %s\n", prefix, pi.DigestRef())))
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	dw.printPublishSummary()
 
-			regPaths := v.RegistryPaths()
-			for _, rp := range regPaths {
+	return dw.writeDigests()
+}
 
-				if err := dw.docker.PushImage(rp, auth, os.Stdout, fmt.Sprintf("[publish/%s]", rp)); err != nil {
-					return err
-				}
+// publishedImage is a pushed image reference and the digest of the pushed
+// manifest
+type publishedImage struct {
+	Ref    string
+	Digest string
+}
 
-			}
-		}
-	} else {
-		for _, name := range names {
-			if dw.aborted {
-				return errAborted
-			}
-			a := dw.buildConfig.Artifacts.GetImage(name)
-			if a == nil {
-				return fmt.Errorf("no such artifact: %s", name)
-			}
-			auth := dw.getRegistryAuth(a.Registry)
+// DigestRef returns the immutable reference i.e. name@sha256:...  It is empty
+// if the registry did not return the digest.
+func (pi publishedImage) DigestRef() string {
+	if pi.Digest == "" {
+		return ""
+	}
+	return imageRepository(pi.Ref) + "@" + pi.Digest
+}
 
-			regPaths := a.RegistryPaths()
-			for _, rp := range regPaths {
+// printPublishSummary writes the digest of each image pushed
+func (dw *DockerWorker) printPublishSummary() {
+	dw.log.Write([]byte("[publish] Summary\n"))
+	for _, pi := range dw.published {
+		dr := pi.DigestRef()
+		if dr == "" {
+			dr = "-"
+		}
+		dw.log.Write([]byte(fmt.Sprintf("[publish] %s %s\n", pi.Ref, dr)))
+	}
+}
 
-				if err := dw.docker.PushImage(rp, auth, os.Stdout, fmt.Sprintf("[publish/%s]", rp)); err != nil {
-					return err
-				}
-			}
+// writeDigests writes the digest references of the pushed images, one per line,
+// to the digests file if configured
+func (dw *DockerWorker) writeDigests() error {
+	file := dw.buildConfig.Artifacts.DigestsFile
+	if file == "" {
+		return nil
+	}
+	var lines []string
+	for _, pi := range dw.published {
+		if dr := pi.DigestRef(); dr != "" {
+			lines = appendUnique(lines, dr)
 		}
 	}
+	var b []byte
+	if len(lines) > 0 {
+		b = []byte(strings.Join(lines, "\n") + "\n")
+	}
+	if err := ioutil.WriteFile(dw.buildConfig.outputPath(file), b, 0644); err != nil {
+		return err
+	}
+	dw.log.Write([]byte(fmt.Sprintf("[publish] Wrote %s\n", file)))
 	return nil
 }
 
 // Build starts the build.  This is a blocking call. index defines one or more
 // build steps to run.  They are in the order as seen in teh config. If no index
 // is provided all builds are run
-func (dw *DockerWorker) Build() error {
+func (dw *DockerWorker) Build(ctx context.Context) error {
 	if len(dw.buildStates) == 0 {
 		return nil
 	}
 
-	done, err := dw.StartBuildAsync(true)
+	done, err := dw.StartBuildAsync(ctx, true)
 	if err != nil {
 		return err
 	}
@@ -380,54 +544,150 @@ func (dw *DockerWorker) Build() error {
 			if b.status != "success" {
 				err = mergeErrors(err, fmt.Errorf("build failed: %s %s", b.Name, b.Container.Image))
 			} else {
-				if e := dw.cacheImage(*b); e != nil {
+				if e := dw.copyOutputs(ctx, b); e != nil {
+					err = mergeErrors(err, fmt.Errorf("copy outputs failed: %s", e))
+				}
+				if e := dw.cacheImage(ctx, *b); e != nil {
 					err = mergeErrors(err, fmt.Errorf("cache failed:: %s", e))
+				} else if e = dw.pushCacheImage(ctx, b); e != nil {
+					// the build itself is good so do not fail it
+					dw.log.Write([]byte(fmt.Sprintf("[build/%s...] ERR Cache push: %s\n", b.shortName, e)))
 				}
 			}
 		}
+		dw.printBuildSummary()
+		if e := dw.enforceCacheRetention(ctx); e != nil {
+			dw.log.Write([]byte("[build] ERR Cache retention: " + e.Error() + "\n"))
+		}
 
-	case <-dw.abort:
+	case <-ctx.Done():
 		dw.log.Write([]byte("[build] Aborting...\n"))
-		if e := dw.stopBuildContainer(); e != nil {
+		// the run context is gone so stop the containers with a fresh one
+		cctx, cancel := cleanupContext()
+		if e := dw.stopBuildContainer(cctx); e != nil {
 			dw.log.Write([]byte("ERR Stopping build containers:" + e.Error() + "\n"))
 		}
+		cancel()
+		err = errAborted
 	}
 
 	return err
 }
 
-func (dw *DockerWorker) stopBuildContainer() error {
+// printBuildSummary writes the status and cache usage of each build step
+func (dw *DockerWorker) printBuildSummary() {
+	dw.log.Write([]byte("[build] Summary\n"))
+	for i, b := range dw.buildStates {
+		c := "-"
+		if b.cache.IsSet() {
+			c = "miss"
+			if b.cache.Hit {
+				c = "hit"
+			}
+		}
+		dw.log.Write([]byte(fmt.Sprintf("[build] %d %-8s cache=%-4s %s\n", i, b.status, c, dw.buildConfig.Build[i].Image)))
+	}
+}
+
+func (dw *DockerWorker) stopBuildContainer(ctx context.Context) error {
 	var err error
 	for _, bc := range dw.buildStates {
+		if bc.ID() == "" {
+			continue
+		}
 		dw.log.Write([]byte("[build] Stopping container: " + bc.ID() + "\n"))
-		err = mergeErrors(err, dw.docker.StopContainer(bc.ID(), time.Duration(defaultStopTimeout)*time.Second))
+		err = mergeErrors(err, dw.docker.StopContainer(ctx, bc.ID(), time.Duration(defaultStopTimeout)*time.Second))
 	}
 	return err
 }
 
-// Abort cancels a running build
-func (dw *DockerWorker) Abort() error {
-	dw.mu.Lock()
-	dw.aborted = true
-	dw.mu.Unlock()
+// cleanupContext returns a bounded context used to clean up after the run
+// context has been cancelled.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), defaultTeardownTimeout)
+}
 
-	dw.abort <- true
+// checkLocalImages fails listing the images of the containers with the pull
+// policy never, i.e. offline, that are not available locally.  This is done
+// before anything is started.  A build step whose cache image is available
+// does not need its image.
+func (dw *DockerWorker) checkLocalImages(ctx context.Context) error {
+	var (
+		missing []string
+		seen    = map[string]bool{}
+	)
+	for _, cs := range append(append([]*containerState{}, dw.serviceStates...), dw.buildStates...) {
+		image := cs.Container.Image
+		if cs.Pull != pullNever || seen[image] {
+			continue
+		}
+		if cs.cache.IsSet() && dw.docker.ImageAvailableLocally(ctx, cs.cache.ToString()) {
+			continue
+		}
+		seen[image] = true
+		if !dw.docker.ImageAvailableLocally(ctx, image) {
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if dw.buildConfig.Offline {
+		return fmt.Errorf("offline and images not available locally: %s", strings.Join(missing, ", "))
+	}
+	return fmt.Errorf("images not available locally with pull policy never: %s", strings.Join(missing, ", "))
+}
+
+// writeContextFiles writes the changelog and build info into the context if
+// configured and not yet written this run
+func (dw *DockerWorker) writeContextFiles(phase string) error {
+	if dw.wroteContextFiles {
+		return nil
+	}
+	if err := dw.buildConfig.writeChangelog(); err != nil {
+		return fmt.Errorf("changelog: %v", err)
+	}
+	if cc := dw.buildConfig.Changelog; cc.File != "" {
+		dw.log.Write([]byte(fmt.Sprintf("[%s/changelog] Wrote %s\n", phase, cc.File)))
+	}
+	if err := dw.buildConfig.writeBuildInfo(); err != nil {
+		return fmt.Errorf("build info: %v", err)
+	}
+	if bi := dw.buildConfig.BuildInfo; bi != "" {
+		dw.log.Write([]byte(fmt.Sprintf("[%s/build-info] Wrote %s\n", phase, bi)))
+	}
+	dw.wroteContextFiles = true
 	return nil
 }
 
 // Setup sets up services needed to perform the build.  These are additional containers
 // that are spun up.  If any error occurs the whole build will bail out
-func (dw *DockerWorker) Setup() error {
+func (dw *DockerWorker) Setup(ctx context.Context) error {
 	var err error
-	if dw.netID, err = dw.docker.CreateNetwork(dw.buildConfig.Name()); err != nil {
+	if err = dw.checkLocalImages(ctx); err != nil {
+		return err
+	}
+	if dw.netID, err = dw.docker.CreateNetwork(ctx, dw.buildConfig.Name()); err != nil {
 		return err
 		// network exists - so move on.
 	}
 	dw.log.Write([]byte(fmt.Sprintf("[configure/network/%s] Created %s\n", dw.buildConfig.Name(), dw.netID)))
 
+	// write before the workspace is setup so it is copied along
+	if err = dw.writeContextFiles("setup"); err != nil {
+		return err
+	}
+
+	if err = dw.setupWorkspace(ctx); err != nil {
+		return err
+	}
+	if err = dw.setupCacheVolumes(ctx); err != nil {
+		return err
+	}
+
 	// Start service containers
 	for _, cs := range dw.serviceStates {
-		if err := dw.docker.StartContainer(cs.ContainerConfig, dw.log, fmt.Sprintf("[setup/service/%s]", cs.Name)); err != nil {
+		if err := dw.docker.StartContainer(ctx, cs.ContainerConfig, dw.log, fmt.Sprintf("[setup/service/%s]", cs.Name)); err != nil {
 			return err
 		}
 		dw.log.Write([]byte(fmt.Sprintf("[setup/service/%s] Started %s\n", cs.Name, cs.Container.Image)))
@@ -436,28 +696,38 @@ func (dw *DockerWorker) Setup() error {
 }
 
 // StartBuildAsync starts the build container/s
-func (dw *DockerWorker) StartBuildAsync(tailLog bool) (chan bool, error) {
+func (dw *DockerWorker) StartBuildAsync(ctx context.Context, tailLog bool) (chan bool, error) {
 
-	dw.done = make(chan bool)
+	dw.done = make(chan bool, 1)
 
-	go dw.watchBuild()
+	go dw.watchBuild(ctx)
 
 	for _, cs := range dw.buildStates {
 		if cs.cache.IsSet() {
 			cacheImgName := cs.cache.ToString()
-			if dw.docker.ImageAvailableLocally(cacheImgName) {
+			if dw.docker.ImageAvailableLocally(ctx, cacheImgName) || dw.pullCacheImage(ctx, cs) {
 				cs.ContainerConfig.Container.Image = cacheImgName
+				// local by now and never in a registry under this name
+				cs.ContainerConfig.Pull = pullIfNotPresent
+				cs.cache.Hit = true
+				dw.log.Write([]byte(fmt.Sprintf("[build/%s...] Cache hit %s\n", cs.shortName, cacheImgName)))
+			} else {
+				dw.log.Write([]byte(fmt.Sprintf("[build/%s...] Cache miss %s\n", cs.shortName, cacheImgName)))
 			}
 		}
 
-		err := dw.docker.StartContainer(cs.ContainerConfig, dw.log, "")
+		err := dw.docker.StartContainer(ctx, cs.ContainerConfig, dw.log, "")
 		if err == nil {
 			dw.log.WithField("container", cs.Name).Write([]byte(fmt.Sprintf("[build/%s...] Started \n", cs.shortName)))
 			if cs.Type == BuildContainerType && tailLog {
 				go func(csID, prefix string) {
 					// wait otherwise docker may return a 404
-					<-time.After(1000 * time.Millisecond)
-					if e := dw.docker.TailLogs(csID, dw.log, prefix); e != nil {
+					select {
+					case <-time.After(1000 * time.Millisecond):
+					case <-ctx.Done():
+						return
+					}
+					if e := dw.docker.TailLogs(ctx, csID, dw.log, prefix); e != nil && ctx.Err() == nil {
 						log.Println("ERR Failed to tail log", e)
 					}
 				}(cs.ID(), fmt.Sprintf("[build/%s...]", cs.shortName))
@@ -469,11 +739,11 @@ func (dw *DockerWorker) StartBuildAsync(tailLog bool) (chan bool, error) {
 	return dw.done, nil
 }
 
-// cacheImage pushes the build image a registry
-func (dw *DockerWorker) cacheImage(cs containerState) error {
+// cacheImage commits the build container as the cache image
+func (dw *DockerWorker) cacheImage(ctx context.Context, cs containerState) error {
 	if cs.cache.IsSet() {
 		img := cs.cache.ToString()
-		if err := dw.docker.BuildImageOfContainer(cs.ID(), img); err != nil {
+		if err := dw.docker.BuildImageOfContainer(ctx, cs.ID(), img, cs.cache.Labels(dw.buildConfig.RepoName)); err != nil {
 			return err
 		}
 	}
@@ -481,43 +751,45 @@ func (dw *DockerWorker) cacheImage(cs containerState) error {
 }
 
 // Teardown stops and removes all services spun up before the build as part of cleanup
-func (dw *DockerWorker) Teardown() error {
+func (dw *DockerWorker) Teardown(ctx context.Context) error {
 	var err error
 	// remove service containers
 	for _, cs := range dw.serviceStates {
-		e := dw.docker.RemoveContainer(cs.ID(), true)
+		e := dw.docker.RemoveContainer(ctx, cs.ID(), true)
 		err = mergeErrors(err, e)
 	}
 	// remove build containers.
 	for _, cs := range dw.buildStates {
 		if !cs.save {
-			e := dw.docker.RemoveContainer(cs.ID(), true)
+			e := dw.docker.RemoveContainer(ctx, cs.ID(), true)
 			err = mergeErrors(err, e)
 		}
 	}
 
+	err = mergeErrors(err, dw.teardownWorkspace(ctx))
+
 	// remove build image if 'cleanup' flag was setted
 	for _, bImage := range dw.buildConfig.Build {
 		if bImage.CleanUp == true {
-			id, err := dw.getImageID(bImage.Image)
+			id, err := dw.getImageID(ctx, bImage.Image)
 			if err != nil {
 				continue
 			}
-			if err = mergeErrors(err, dw.docker.RemoveImage(id, true, bImage.CleanUp)); err != nil {
+			if err = mergeErrors(err, dw.docker.RemoveImage(ctx, id, true, bImage.CleanUp)); err != nil {
 				log.Printf("ERR [Teardown] Removing image %s: %s\n", bImage.Image, err.Error())
 			}
 		}
 	}
 
-	err = mergeErrors(err, dw.docker.RemoveNetwork(dw.netID))
+	err = mergeErrors(err, dw.docker.RemoveNetwork(ctx, dw.netID))
 
 	for _, a := range dw.buildConfig.Artifacts.Images {
 		if a.CleanUp {
-			id, err := dw.getImageID(a.Name)
+			id, err := dw.getImageID(ctx, a.Name)
 			if err != nil {
 				continue
 			}
-			if err = mergeErrors(err, dw.docker.RemoveImage(id, true, a.CleanUp)); err != nil {
+			if err = mergeErrors(err, dw.docker.RemoveImage(ctx, id, true, a.CleanUp)); err != nil {
 				log.Println("ERR [Teardown] Removing images:", err.Error())
 			}
 		}
@@ -526,12 +798,12 @@ func (dw *DockerWorker) Teardown() error {
 }
 
 // getImageID returns image  ID by repository name
-func (dw *DockerWorker) getImageID(repoName string) (string, error) {
+func (dw *DockerWorker) getImageID(ctx context.Context, repoName string) (string, error) {
 	// adding default tag "latest" if there are no tags
 	if len(strings.Split(repoName, ":")) == 1 {
 		repoName += ":latest"
 	}
-	imagesInfo, err := dw.docker.cli.ImageList(context.Background(), types.ImageListOptions{All: true})
+	imagesInfo, err := dw.docker.cli.ImageList(ctx, types.ImageListOptions{All: true})
 	if err != nil {
 		return "", err
 	}
@@ -575,11 +847,14 @@ func (dw *DockerWorker) markContainerDone(id, status string, state *types.Contai
 	return true
 }
 
-func (dw *DockerWorker) watchBuild() {
+func (dw *DockerWorker) watchBuild(ctx context.Context) {
 	cli := dw.docker.Client()
-	msgCh, errCh := cli.Events(context.Background(), types.EventsOptions{})
+	msgCh, errCh := cli.Events(ctx, types.EventsOptions{})
 	for {
 		select {
+		case <-ctx.Done():
+			return
+
 		case msg := <-msgCh:
 
 			switch msg.Action {
@@ -600,7 +875,7 @@ func (dw *DockerWorker) watchBuild() {
 						status string
 						state  types.ContainerState
 					)
-					if cj, err := cli.ContainerInspect(context.Background(), msg.Actor.ID); err == nil {
+					if cj, err := cli.ContainerInspect(ctx, msg.Actor.ID); err == nil {
 						if cj.State.ExitCode != 0 {
 							status = "failed"
 						} else {
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,16 +62,16 @@ func Test_Worker_Build(t *testing.T) {
 	testMc, worker, _ := initializeBuild("./testdata/mold2.yml", "")
 	worker.Configure(testMc)
 
-	if err := worker.Setup(); err != nil {
+	if err := worker.Setup(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := worker.Build(); err != nil {
-		worker.Teardown()
+	if err := worker.Build(context.Background()); err != nil {
+		worker.Teardown(context.Background())
 		t.Fatal(err)
 	}
 
-	if err := worker.Teardown(); err != nil {
+	if err := worker.Teardown(context.Background()); err != nil {
 		t.Log(err)
 		t.Fail()
 	}
@@ -74,21 +81,42 @@ func Test_Worker_Build(t *testing.T) {
 	}
 }
 
+func Test_Worker_Build_Abort(t *testing.T) {
+	testMc, worker, _ := initializeBuild("./testdata/mold2.yml", "")
+	worker.Configure(testMc)
+	if err := worker.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Teardown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- worker.Build(ctx)
+	}()
+
+	<-time.After(500 * time.Millisecond)
+	cancel()
+	if err := <-errCh; err == nil {
+		t.Fatal("should fail when aborted")
+	}
+}
+
 func Test_Worker_GeneratesArtifacts(t *testing.T) {
 	testMc, worker, _ := initializeBuild("./testdata/mold1.yml", "")
 	worker.Configure(testMc)
 
-	if err := worker.GenerateArtifacts(); err != nil {
+	if err := worker.GenerateArtifacts(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	if err := worker.RemoveArtifacts(); err != nil {
+	if err := worker.RemoveArtifacts(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	if err := worker.GenerateArtifacts("d3sw/mold-test"); err != nil {
+	if err := worker.GenerateArtifacts(context.Background(), "d3sw/mold-test"); err != nil {
 		t.Fatal(err)
 	}
-	worker.RemoveArtifacts()
-	if err := worker.GenerateArtifacts("foo"); err == nil {
+	worker.RemoveArtifacts(context.Background())
+	if err := worker.GenerateArtifacts(context.Background(), "foo"); err == nil {
 		t.Fatal("should fail with artifact not found")
 	}
 }
@@ -99,14 +127,15 @@ func Test_Worker_GeneratesArtifacts_Abort(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
 	go func() {
-		if err := worker.GenerateArtifacts(); err != nil {
-			t.Fatal(err)
-		}
+		errCh <- worker.GenerateArtifacts(ctx)
 	}()
 
 	<-time.After(1500 * time.Millisecond)
-	if err := worker.Abort(); err != nil {
+	cancel()
+	if err := <-errCh; err != nil && err != errAborted {
 		t.Fatal(err)
 	}
 }
@@ -114,7 +143,7 @@ func Test_Worker_GeneratesArtifacts_Abort(t *testing.T) {
 func Test_Worker_Publish_fail(t *testing.T) {
 	_, worker, _ := initializeBuild(testMoldCfg, "")
 	worker.authCfg = nil
-	if err := worker.Publish(); err == nil {
+	if err := worker.Publish(context.Background()); err == nil {
 		t.Fatal("should fail")
 	}
 }
@@ -125,7 +154,7 @@ func Test_Worker_Publish_fail2(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := worker.Publish(); err == nil {
+	if err := worker.Publish(context.Background()); err == nil {
 		t.Fatalf("should fail with image not found: %+v", testMc.Artifacts.Images)
 	}
 }
@@ -135,7 +164,7 @@ func Test_BuildListenOnPort(t *testing.T) {
 	if err := worker.Configure(testMc); err != nil {
 		t.Fatal(err)
 	}
-	if err := worker.GenerateArtifacts(); err != nil {
+	if err := worker.GenerateArtifacts(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
@@ -174,20 +203,91 @@ func Test_Publish(t *testing.T) {
 		Auths: make(map[string]types.AuthConfig, 0),
 	}
 
-	err := d.Publish("")
+	err := d.Publish(context.Background(), "")
 	if err.Error() != "registry auth not specified" {
 		t.Fatal("should be error \"registry auth not specified\"")
 	}
 
-	err = d.Publish("uno,dos,tres")
+	err = d.Publish(context.Background(), "uno,dos,tres")
 	if err.Error() != "registry auth not specified" {
 		t.Fatal("should be error \"registry auth not specified\"")
 	}
 
 	images := "раз,два,три"
 	d.authCfg.Auths["docker"] = types.AuthConfig{Username: "UnknownEmpty"}
-	err = d.Publish(images)
+	err = d.Publish(context.Background(), images)
 	if err.Error() != fmt.Sprintf("no such artifact: %s", images) {
 		t.Fatal(err.Error())
 	}
 }
+
+func Test_Worker_writeDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mold-digests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mc := &MoldConfig{Context: dir}
+	mc.Artifacts.DigestsFile = "digests.txt"
+	dw := DockerWorker{
+		buildConfig: mc,
+		log:         &Log{Writer: ioutil.Discard},
+		published: []publishedImage{
+			{Ref: "registry:5000/app", Digest: "sha256:abc"},
+			{Ref: "registry:5000/app:v1", Digest: "sha256:abc"},
+			{Ref: "other:v1", Digest: "sha256:def"},
+			{Ref: "nodigest:v1"},
+		},
+	}
+	if err = dw.writeDigests(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "digests.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "registry:5000/app@sha256:abc\nother@sha256:def\n" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func Test_Worker_checkLocalImages(t *testing.T) {
+	// daemon with only golang available locally
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/images/golang/json") {
+			fmt.Fprint(w, `{"Id":"sha256:abc"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"no such image"}`)
+	}))
+	defer srv.Close()
+
+	d, err := NewDockerWithConfig(&DockerClientConfig{Host: "tcp://" + strings.TrimPrefix(srv.URL, "http://"), APIVersion: "1.25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := &MoldConfig{
+		Services: []DockerRunConfig{{Image: "redis"}},
+		Build:    []DockerRunConfig{{Image: "golang"}},
+	}
+	dw := &DockerWorker{docker: d, buildConfig: mc}
+	services, _ := assembleServiceContainers(mc)
+	builds, _, _ := assembleBuildContainers(mc, "")
+	dw.serviceStates = []*containerState{{ContainerConfig: services[0]}}
+	dw.buildStates = []*containerState{{ContainerConfig: builds[0]}}
+	if err = dw.checkLocalImages(context.Background()); err != nil {
+		t.Fatal("should pull if not present", err)
+	}
+
+	mc.Offline = true
+	services, _ = assembleServiceContainers(mc)
+	builds, _, _ = assembleBuildContainers(mc, "")
+	dw.serviceStates = []*containerState{{ContainerConfig: services[0]}}
+	dw.buildStates = []*containerState{{ContainerConfig: builds[0]}}
+	err = dw.checkLocalImages(context.Background())
+	if err == nil || err.Error() != "offline and images not available locally: redis" {
+		t.Fatal("should fail listing the missing images", err)
+	}
+}
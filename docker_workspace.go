@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	workspaceBind   = "bind"   // bind mount the context from the host
+	workspaceVolume = "volume" // copy the context into a named volume
+
+	// path the workspace volume is mounted at in the copy container
+	workspaceMountPath = "/mold/workspace"
+)
+
+// workspace is a named volume holding a copy of the context.  It is shared by
+// all build containers and used as the artifact build context.
+type workspace struct {
+	Volume    string
+	container *ContainerConfig // created but never started.  Used to copy data in and out.
+}
+
+func newWorkspace(mc *MoldConfig) *workspace {
+	if mc.Workspace != workspaceVolume || len(mc.Build) == 0 {
+		return nil
+	}
+	return &workspace{Volume: fmt.Sprintf("%s-workspace-%d", mc.Name(), time.Now().UnixNano())}
+}
+
+// setupWorkspace creates the workspace volume and copies the context into it
+// respecting the .dockerignore file.
+func (dw *DockerWorker) setupWorkspace(ctx context.Context) error {
+	ws := dw.workspace
+	if ws == nil {
+		return nil
+	}
+	prefix := fmt.Sprintf("[setup/workspace/%s]", ws.Volume)
+
+	if err := dw.docker.CreateVolume(ctx, ws.Volume, nil); err != nil {
+		return err
+	}
+	dw.log.Write([]byte(prefix + " Created\n"))
+
+	// Use the first build image as it is needed for the build anyway.
+	cc := DefaultContainerConfig(dw.buildConfig.Build[0].Image)
+	cc.Pull = dw.buildConfig.pullPolicy(dw.buildConfig.Build[0])
+	cc.Name = ws.Volume
+	cc.Container.Cmd = []string{"true"}
+	cc.Container.Volumes[workspaceMountPath] = struct{}{}
+	cc.Host.Binds = []string{ws.Volume + ":" + workspaceMountPath}
+	if err := dw.docker.CreateContainer(ctx, cc, dw.log, prefix); err != nil {
+		return err
+	}
+	ws.container = cc
+
+	bldCxt, err := tarDirectory(dw.buildConfig.Context)
+	if err != nil {
+		return err
+	}
+	defer bldCxt.Close()
+
+	if err = dw.docker.CopyToContainer(ctx, cc.ID(), workspaceMountPath, bldCxt); err != nil {
+		return err
+	}
+	dw.log.Write([]byte(prefix + " Copied " + dw.buildConfig.Context + "\n"))
+	return nil
+}
+
+// artifactContext returns the tar archive to be used as the build context for
+// the image.  This is read from the workspace volume if one is in use and the
+// image context is within it, otherwise from the host.
+func (dw *DockerWorker) artifactContext(ctx context.Context, ic *ImageConfig) (io.ReadCloser, error) {
+	ws := dw.workspace
+	if ws == nil || ws.container == nil {
+		return tarDirectory(ic.Context)
+	}
+
+	rel, err := filepath.Rel(dw.buildConfig.Context, ic.Context)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return tarDirectory(ic.Context)
+	}
+	src := path.Join(workspaceMountPath, filepath.ToSlash(rel)) + "/."
+	return dw.docker.CopyFromContainer(ctx, ws.container.ID(), src)
+}
+
+// teardownWorkspace removes the copy container and the volume.  The volume is
+// kept if any build container is being saved as it is still referenced.
+func (dw *DockerWorker) teardownWorkspace(ctx context.Context) error {
+	ws := dw.workspace
+	if ws == nil {
+		return nil
+	}
+
+	var err error
+	if ws.container != nil {
+		err = dw.docker.RemoveContainer(ctx, ws.container.ID(), true)
+	}
+	for _, cs := range dw.buildStates {
+		if cs.save {
+			return err
+		}
+	}
+	return mergeErrors(err, dw.docker.RemoveVolume(ctx, ws.Volume, true))
+}
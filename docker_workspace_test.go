@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+func Test_newWorkspace(t *testing.T) {
+	mc, err := readMoldConfig("testdata/mold.volume.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newWorkspace(mc)
+	if ws == nil || ws.Volume == "" {
+		t.Fatal("workspace should be set")
+	}
+
+	bc, _, err := assembleBuildContainers(mc, ws.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := bc[0].Host.Mounts[0]
+	if m.Type != mount.TypeVolume || m.Source != ws.Volume || m.Target != "/src" {
+		t.Fatalf("workspace volume not mounted: %+v", m)
+	}
+
+	mc.Workspace = workspaceBind
+	if newWorkspace(mc) != nil {
+		t.Fatal("workspace should not be set when binding")
+	}
+}
+
+func Test_NewMoldConfig_InvalidWorkspace(t *testing.T) {
+	if _, err := NewMoldConfig([]byte("workspace: foo\n")); err == nil {
+		t.Fatal("should fail with invalid workspace")
+	}
+}
+
+func Test_LifeCycle_VolumeWorkspace(t *testing.T) {
+	mc, worker, err := initializeBuild("./testdata/mold.volume.yml", *dockerURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := NewLifeCycle(worker)
+	if err := lc.Run(mc); err != nil {
+		t.Fatal(err)
+	}
+}
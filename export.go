@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Export formats
+const (
+	exportTarGz = "tar.gz"
+	exportOCI   = "oci"
+)
+
+// files written to the export path along with the images
+const (
+	exportManifestFile  = "manifest.json"
+	exportChecksumsFile = "SHA256SUMS"
+)
+
+// OCI image layout media types
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// ExportConfig saves the artifact images as files i.e. for air-gapped installs
+type ExportConfig struct {
+	Path   string `yaml:",omitempty"` // directory relative to the context
+	Format string `yaml:",omitempty"` // tar.gz (default) or oci
+	// branches/tags exported on when publishing.  Defaults to those of the
+	// artifacts.
+	Publish []string `yaml:",omitempty"`
+}
+
+// IsSet returns whether exporting is configured
+func (ec *ExportConfig) IsSet() bool {
+	return ec != nil && ec.Path != ""
+}
+
+func (ec *ExportConfig) parse() error {
+	if !ec.IsSet() {
+		return nil
+	}
+	if err := validateContextFile("export", ec.Path); err != nil {
+		return err
+	}
+	switch ec.Format {
+	case "":
+		ec.Format = exportTarGz
+	case exportTarGz, exportOCI:
+	default:
+		return fmt.Errorf("export: invalid format: %s", ec.Format)
+	}
+	return nil
+}
+
+// exportedImage is an entry of the export manifest
+type exportedImage struct {
+	Image  string   `json:"image"`
+	Tags   []string `json:"tags"`
+	Path   string   `json:"path"` // relative to the export path
+	Format string   `json:"format"`
+	SHA256 string   `json:"sha256"` // of the tarball or the oci index
+}
+
+// exports returns whether the images are exported when publishing on the
+// branch/tag
+func (art *Artifacts) exports(branchTag string) bool {
+	if !art.Export.IsSet() {
+		return false
+	}
+	conds := art.Export.Publish
+	if conds == nil {
+		conds = art.Publish
+	}
+	return matchPublish(conds, branchTag)
+}
+
+// Export saves the artifact images, or the named ones, to the export path.  A
+// manifest listing the tags of each image and the checksums are written along
+// with them.
+func (dw *DockerWorker) Export(ctx context.Context, names ...string) error {
+	ec := dw.buildConfig.Artifacts.Export
+	if !ec.IsSet() {
+		return fmt.Errorf("export not configured")
+	}
+
+	var images []*ImageConfig
+	if len(names) == 0 {
+		for i := range dw.buildConfig.Artifacts.Images {
+			images = append(images, &dw.buildConfig.Artifacts.Images[i])
+		}
+	} else {
+		for _, name := range names {
+			ic := dw.buildConfig.Artifacts.GetImage(name)
+			if ic == nil {
+				return fmt.Errorf("no such artifact: %s", name)
+			}
+			images = append(images, ic)
+		}
+	}
+
+	dir := dw.buildConfig.outputPath(ec.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var exported []exportedImage
+	for _, ic := range images {
+		if ctx.Err() != nil {
+			return errAborted
+		}
+		ei, err := dw.exportImage(ctx, ic, dir, ec.Format)
+		if err != nil {
+			return err
+		}
+		dw.log.Write([]byte(fmt.Sprintf("[export/%s] Saved %s %s\n", ic.Name, ei.Path, ei.SHA256)))
+		exported = append(exported, ei)
+	}
+	return writeExportManifest(dir, exported)
+}
+
+func (dw *DockerWorker) exportImage(ctx context.Context, ic *ImageConfig, dir, format string) (exportedImage, error) {
+	ei := exportedImage{Image: ic.Name, Tags: ic.DefaultRegistryPaths(), Format: format}
+	rd, err := dw.docker.SaveImages(ctx, ei.Tags)
+	if err != nil {
+		return ei, err
+	}
+	defer rd.Close()
+
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(ic.Name)
+	if format == exportOCI {
+		ei.Path = name
+		ei.SHA256, err = writeOCILayout(rd, filepath.Join(dir, name))
+	} else {
+		ei.Path = name + ".tar.gz"
+		ei.SHA256, err = writeGzipFile(rd, filepath.Join(dir, ei.Path))
+	}
+	return ei, err
+}
+
+// writeGzipFile writes the gzipped content to the file returning the hex sha256
+// of the file
+func writeGzipFile(rd io.Reader, file string) (string, error) {
+	fh, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(fh, h))
+	if _, err = io.Copy(gz, rd); err != nil {
+		return "", err
+	}
+	if err = gz.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), fh.Close()
+}
+
+// descriptor of content in an oci layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// entry of the manifest.json of docker save
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// writeOCILayout converts the docker save archive to an oci image layout in the
+// directory returning the hex sha256 of its index.  Layers are stored as is i.e.
+// uncompressed.  The config and layers are those listed in manifest.json which
+// are */layer.tar and <id>.json for the legacy format and blobs/sha256/<hex>
+// since docker 25.  As manifest.json can come last every file is stored and
+// those not referenced removed.
+func writeOCILayout(rd io.Reader, dir string) (string, error) {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return "", err
+	}
+
+	var (
+		tr        = tar.NewReader(rd)
+		descs     = map[string]ociDescriptor{} // by archive path
+		links     = map[string]string{}        // symlinks to their target
+		manifests []dockerSaveManifest
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == "manifest.json":
+			if err = json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return "", err
+			}
+		case hdr.Typeflag == tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case hdr.Typeflag == tar.TypeReg:
+			d, err := writeBlob(tr, blobs)
+			if err != nil {
+				return "", err
+			}
+			descs[name] = d
+		}
+	}
+	if len(manifests) == 0 {
+		return "", fmt.Errorf("no images in archive")
+	}
+	// archive entry of the path, a symlink is the entry of its target
+	entry := func(p string) (ociDescriptor, bool) {
+		p = path.Clean(p)
+		if target, ok := links[p]; ok {
+			p = target
+		}
+		d, ok := descs[p]
+		return d, ok
+	}
+	used := map[string]bool{}
+
+	var index ociIndex
+	index.SchemaVersion = 2
+	for _, m := range manifests {
+		om := ociManifest{SchemaVersion: 2}
+		cfg, ok := entry(m.Config)
+		if !ok {
+			return "", fmt.Errorf("config not in archive: %s", m.Config)
+		}
+		cfg.MediaType = ociConfigMediaType
+		om.Config = cfg
+		used[cfg.Digest] = true
+		for _, l := range m.Layers {
+			ld, ok := entry(l)
+			if !ok {
+				return "", fmt.Errorf("layer not in archive: %s", l)
+			}
+			ld.MediaType = ociLayerMediaType
+			om.Layers = append(om.Layers, ld)
+			used[ld.Digest] = true
+		}
+
+		b, err := json.Marshal(om)
+		if err != nil {
+			return "", err
+		}
+		md, err := writeBlob(bytes.NewReader(b), blobs)
+		if err != nil {
+			return "", err
+		}
+		md.MediaType = ociManifestMediaType
+		used[md.Digest] = true
+		for _, rt := range m.RepoTags {
+			d := md
+			d.Annotations = map[string]string{ociRefNameAnnotation: rt[strings.LastIndex(rt, ":")+1:]}
+			index.Manifests = append(index.Manifests, d)
+		}
+	}
+
+	for _, d := range descs {
+		if !used[d.Digest] {
+			if err := os.Remove(filepath.Join(blobs, strings.TrimPrefix(d.Digest, "sha256:"))); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), ioutil.WriteFile(filepath.Join(dir, "index.json"), b, 0644)
+}
+
+// writeBlob writes the content to the blobs directory named by its digest
+func writeBlob(rd io.Reader, blobs string) (ociDescriptor, error) {
+	var d ociDescriptor
+	tmp, err := ioutil.TempFile(blobs, ".blob")
+	if err != nil {
+		return d, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if d.Size, err = io.Copy(io.MultiWriter(tmp, h), rd); err != nil {
+		tmp.Close()
+		return d, err
+	}
+	if err = tmp.Close(); err != nil {
+		return d, err
+	}
+	hx := hex.EncodeToString(h.Sum(nil))
+	d.Digest = "sha256:" + hx
+	return d, os.Rename(tmp.Name(), filepath.Join(blobs, hx))
+}
+
+// writeExportManifest writes the manifest of the exported images and their
+// checksums in the format of sha256sum
+func writeExportManifest(dir string, exported []exportedImage) error {
+	b, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, exportManifestFile), append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	var sums []string
+	for _, ei := range exported {
+		file := ei.Path
+		if ei.Format == exportOCI {
+			file = path.Join(ei.Path, "index.json")
+		}
+		sums = append(sums, fmt.Sprintf("%s  %s\n", ei.SHA256, file))
+	}
+	return ioutil.WriteFile(filepath.Join(dir, exportChecksumsFile), []byte(strings.Join(sums, "")), 0644)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dockerSaveArchive returns an archive as docker save writes it with one image
+// of two layers that are the same.  The legacy format links the second to the
+// first, the oci based format of docker 25+ lists the blob twice.
+func dockerSaveArchive(t *testing.T, legacy bool) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name, content string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if legacy {
+		add("abc/VERSION", "1.0")
+		add("abc/json", "{}")
+		add("abc/layer.tar", "layer")
+		tw.WriteHeader(&tar.Header{Name: "def/layer.tar", Linkname: "../abc/layer.tar", Typeflag: tar.TypeSymlink})
+		add("123.json", `{"architecture":"amd64"}`)
+		add("manifest.json", `[{"Config":"123.json","RepoTags":["d3sw/app:latest","d3sw/app:1.2.3"],"Layers":["abc/layer.tar","def/layer.tar"]}]`)
+	} else {
+		cfg, layer := sha256Hex([]byte(`{"architecture":"amd64"}`)), sha256Hex([]byte("layer"))
+		add("oci-layout", `{"imageLayoutVersion":"1.0.0"}`)
+		add("index.json", `{"schemaVersion":2,"manifests":[]}`)
+		add("manifest.json", `[{"Config":"blobs/sha256/`+cfg+`","RepoTags":["d3sw/app:latest","d3sw/app:1.2.3"],"Layers":["blobs/sha256/`+layer+`","blobs/sha256/`+layer+`"]}]`)
+		add("blobs/sha256/"+cfg, `{"architecture":"amd64"}`)
+		add("blobs/sha256/"+layer, "layer")
+		add("blobs/sha256/"+sha256Hex([]byte("manifest")), "manifest")
+	}
+	add("repositories", "{}")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_writeOCILayout(t *testing.T) {
+	for _, legacy := range []bool{true, false} {
+		testWriteOCILayout(t, dockerSaveArchive(t, legacy))
+	}
+
+	dir, err := ioutil.TempDir("", "mold-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = writeOCILayout(bytes.NewReader(nil), dir); err == nil {
+		t.Fatal("should fail without images")
+	}
+}
+
+func testWriteOCILayout(t *testing.T, archive []byte) {
+	dir, err := ioutil.TempDir("", "mold-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sum, err := writeOCILayout(bytes.NewReader(archive), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != sha256Hex(b) {
+		t.Fatal("wrong index checksum")
+	}
+	var index ociIndex
+	if err = json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 || index.Manifests[1].Annotations[ociRefNameAnnotation] != "1.2.3" {
+		t.Fatalf("%+v", index)
+	}
+
+	blob := func(digest string) []byte {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if "sha256:"+sha256Hex(b) != digest {
+			t.Fatal("content does not match digest", digest)
+		}
+		return b
+	}
+	var m ociManifest
+	if err = json.Unmarshal(blob(index.Manifests[0].Digest), &m); err != nil {
+		t.Fatal(err)
+	}
+	if string(blob(m.Config.Digest)) != `{"architecture":"amd64"}` || m.Config.MediaType != ociConfigMediaType {
+		t.Fatalf("wrong config %+v", m.Config)
+	}
+	if len(m.Layers) != 2 || m.Layers[0].Digest != m.Layers[1].Digest || string(blob(m.Layers[0].Digest)) != "layer" {
+		t.Fatalf("wrong layers %+v", m.Layers)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		t.Fatal(err)
+	}
+	// only the manifest, config and layer
+	if fis, _ := ioutil.ReadDir(filepath.Join(dir, "blobs", "sha256")); len(fis) != 3 {
+		t.Fatal("should remove unreferenced blobs:", len(fis))
+	}
+}
+
+func Test_writeGzipFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mold-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.tar.gz")
+	sum, err := writeGzipFile(strings.NewReader("image"), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != sha256Hex(b) {
+		t.Fatal("wrong checksum")
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = ioutil.ReadAll(gz); string(b) != "image" {
+		t.Fatal("wrong content", string(b))
+	}
+
+	err = writeExportManifest(dir, []exportedImage{
+		{Image: "app", Path: "app.tar.gz", Format: exportTarGz, SHA256: sum},
+		{Image: "oci", Path: "oci", Format: exportOCI, SHA256: "abc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(dir, exportChecksumsFile))
+	if string(b) != sum+"  app.tar.gz\nabc  oci/index.json\n" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func Test_ExportConfig(t *testing.T) {
+	ec := ExportConfig{Path: "dist/images"}
+	if err := ec.parse(); err != nil || ec.Format != exportTarGz {
+		t.Fatal("should default to tar.gz", err)
+	}
+	if err := (&ExportConfig{Path: "dist", Format: "zip"}).parse(); err == nil {
+		t.Fatal("should fail on an invalid format")
+	}
+	if err := (&ExportConfig{Path: "../dist"}).parse(); err == nil {
+		t.Fatal("should fail outside of the context")
+	}
+
+	art := Artifacts{Publish: []string{"master"}, Export: ec}
+	if !art.exports("master") || art.exports("feature") {
+		t.Fatal("should default to the artifacts publish")
+	}
+	art.Export.Publish = []string{"^v"}
+	if art.exports("master") || !art.exports("v1.0.0") {
+		t.Fatal("should use the export publish")
+	}
+}
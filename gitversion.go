@@ -2,22 +2,42 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"gopkg.in/src-d/go-billy.v3/osfs"
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 )
 
 type gitVersion struct {
 	r       *git.Repository
 	visited map[plumbing.Hash]struct{}
+	// git dir of a linked worktree holding its HEAD.  Empty otherwise.
+	linkedGitDir string
+	// revision versioned instead of HEAD if set
+	ref string
 
 	head      *plumbing.Reference
 	tags      map[plumbing.Hash]*plumbing.Reference
 	latestTag *plumbing.Reference
+	tagCommit plumbing.Hash // commit the latest tag points to
 	distance  int
+	branch    string
+	next      string
+	dirty     bool // uncommitted changes to tracked files
+
+	// repo relative paths commits must touch to count.  All if empty.
+	paths []string
+
+	// strategy used to compute the version
+	config VersionConfig
 }
 
 func (gt *gitVersion) getTag(hash string) string {
@@ -29,17 +49,184 @@ func (gt *gitVersion) getTag(hash string) string {
 	return v.Name().Short()
 }
 
+// newGitVersion returns the version info of the repo at the path with the
+// default versioning config
 func newGitVersion(path string) (*gitVersion, error) {
-	r, err := git.PlainOpen(path)
+	var cfg VersionConfig
+	if err := cfg.parse(); err != nil {
+		return nil, err
+	}
+	return newGitVersionWithConfig(path, cfg)
+}
+
+// newGitVersionWithConfig returns the version info of the repo at the path.  The
+// config determines the tags considered and how the version is computed.
+func newGitVersionWithConfig(path string, cfg VersionConfig) (*gitVersion, error) {
+	return newGitVersionAtRef(path, cfg, "")
+}
+
+// newGitVersionAtRef returns the version of the project at path as of the ref
+// i.e. a branch, tag or commit.  HEAD is used if the ref is empty.  The working
+// tree is not looked at for a ref so it is never dirty.
+func newGitVersionAtRef(path string, cfg VersionConfig, ref string) (*gitVersion, error) {
+	gt := &gitVersion{config: cfg, ref: ref}
+
+	root, err := findRepoRoot(path)
 	if err != nil {
-		return &gitVersion{}, err
+		return gt, err
+	}
+	if gt.r, gt.linkedGitDir, err = openRepo(root); err != nil {
+		return gt, err
+	}
+	if gt.paths, err = repoPaths(root, path, cfg.Paths); err != nil {
+		return gt, err
+	}
+
+	if ref != "" {
+		if gt.head, err = gt.resolveRef(ref); err != nil {
+			return gt, err
+		}
 	}
 
-	gt := &gitVersion{r: r}
 	gt.initVersion()
 	return gt, nil
 }
 
+// findRepoRoot returns the closest directory from the path up containing .git
+// so a project in a sub directory of the repo, e.g. a monorepo, is supported.
+func findRepoRoot(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err = os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", git.ErrRepositoryNotExists
+		}
+		dir = parent
+	}
+}
+
+// openRepo opens the repo of the working directory.  Submodules, where .git is
+// a file pointing to the git dir, are handled by go-git.  Linked worktrees have a
+// git dir with a commondir file pointing to the main git dir holding the objects
+// and refs.  These are opened from the common dir returning the linked git dir
+// where the HEAD of the worktree is.
+func openRepo(root string) (*git.Repository, string, error) {
+	gitDir := filepath.Join(root, ".git")
+	if b, err := ioutil.ReadFile(gitDir); err == nil {
+		// .git file i.e. gitdir: <path>
+		gitDir = strings.TrimSpace(strings.TrimPrefix(string(b), "gitdir:"))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(root, gitDir)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		r, err := git.PlainOpen(root)
+		return r, "", err
+	}
+	common := strings.TrimSpace(string(b))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitDir, common)
+	}
+	st, err := filesystem.NewStorage(osfs.New(common))
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := git.Open(st, osfs.New(root))
+	return r, gitDir, err
+}
+
+// resolveHead returns HEAD resolved to the commit.  It is the branch reference
+// if one is checked out.
+func (gt *gitVersion) resolveHead() (*plumbing.Reference, error) {
+	if gt.linkedGitDir == "" {
+		return gt.r.Head()
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(gt.linkedGitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, "ref: ") {
+		return plumbing.NewHashReference(plumbing.HEAD, plumbing.NewHash(s)), nil
+	}
+	name := plumbing.ReferenceName(strings.TrimPrefix(s, "ref: "))
+	ref, err := storer.ResolveReference(gt.r.Storer, name)
+	if err != nil {
+		return nil, err
+	}
+	return plumbing.NewHashReference(name, ref.Hash()), nil
+}
+
+// resolveRef returns the reference of a branch or otherwise the commit of a tag
+// or hash as a detached HEAD.
+func (gt *gitVersion) resolveRef(ref string) (*plumbing.Reference, error) {
+	if br, err := gt.r.Reference(plumbing.ReferenceName("refs/heads/"+ref), true); err == nil {
+		return br, nil
+	}
+	h, err := gt.resolveCommit(ref)
+	if err != nil {
+		return nil, err
+	}
+	return plumbing.NewHashReference(plumbing.HEAD, h), nil
+}
+
+// repoInfo returns the branch, tag, commit and url of the checked out revision.
+// The url is that of the origin remote, or the first one if none.
+func (gt *gitVersion) repoInfo() repoInfo {
+	var ri repoInfo
+	if gt.head == nil {
+		return ri
+	}
+	ri.Commit = gt.head.Hash().String()
+	if gt.head.IsBranch() {
+		ri.Branch = gt.head.Name().Short()
+	}
+	ri.Tag = gt.getTag(ri.Commit)
+
+	if cfg, err := gt.r.Config(); err == nil {
+		if rc, ok := cfg.Remotes["origin"]; ok {
+			ri.URL = rc.URL
+		} else {
+			for _, rc := range cfg.Remotes {
+				ri.URL = rc.URL
+				break
+			}
+		}
+	}
+	ri.URL = stripURLCredentials(ri.URL)
+	return ri
+}
+
+// repoPaths converts the paths relative to dir to slash separated paths relative
+// to the repo root.
+func repoPaths(root, dir string, paths []string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel, err := filepath.Rel(root, filepath.Join(dir, p))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("versioning: path outside of the repo: %s", p)
+		}
+		out = append(out, filepath.ToSlash(rel))
+	}
+	return out, nil
+}
+
 func (gt *gitVersion) Commit() string {
 	if gt.head == nil {
 		return ""
@@ -51,25 +238,316 @@ func (gt *gitVersion) TagVersion() string {
 	if gt.latestTag == nil {
 		return "0.0.0"
 	}
-	return strings.TrimPrefix(gt.latestTag.Name().Short(), "v")
+	return strings.TrimPrefix(gt.latestTag.Name().Short(), gt.config.tagPrefix())
 }
 
+// Version returns the version computed with the configured strategy.  The dirty
+// suffix is appended if the working tree has uncommitted changes.
 func (gt *gitVersion) Version() string {
-	cmt := gt.Commit()
+	v := gt.config.format(gt.info())
+	if gt.dirty {
+		v += gt.config.DirtySuffix
+	}
+	return v
+}
+
+// Dirty reports whether tracked files, within the configured paths if any, have
+// uncommitted changes.  Untracked files are ignored as with git describe --dirty.
+func (gt *gitVersion) Dirty() bool {
+	return gt.dirty
+}
+
+func (gt *gitVersion) isDirty() (bool, error) {
+	// the index of a linked worktree is not in the common dir so the status
+	// would be that of the main worktree
+	if gt.linkedGitDir != "" {
+		return false, nil
+	}
+	wt, err := gt.r.Worktree()
+	if err != nil {
+		return false, err
+	}
+	st, err := wt.Status()
+	if err != nil {
+		return false, err
+	}
+	for name, fs := range st {
+		if fs.Staging == git.Untracked && fs.Worktree == git.Untracked {
+			continue
+		}
+		if fs.Staging == git.Unmodified && fs.Worktree == git.Unmodified {
+			continue
+		}
+		if gt.inPaths(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// inPaths reports whether the repo relative file is within the configured paths
+func (gt *gitVersion) inPaths(name string) bool {
+	if len(gt.paths) == 0 {
+		return true
+	}
+	name = filepath.ToSlash(name)
+	for _, p := range gt.paths {
+		if p == "." || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// NextVersion returns the version to release inferred from the conventional
+// commits since the latest tag.  It is the tag itself if the commit is tagged
+// and empty if the tag is not a semantic version.
+func (gt *gitVersion) NextVersion() string {
+	if gt.head == nil {
+		return ""
+	}
+	if gt.next != "" {
+		return gt.next
+	}
+
 	tv := gt.TagVersion()
-	if cmt == "" || gt.distance == 0 {
-		return tv
+	sv := parseSemver(tv)
+	if !sv.valid {
+		return ""
+	}
+	if gt.latestTag != nil && gt.distance == 0 {
+		gt.next = tv
+		return gt.next
+	}
+
+	msgs, err := gt.messagesSinceTag()
+	if err != nil {
+		return ""
+	}
+	gt.next = sv.bump(conventionalBump(msgs)).String()
+	return gt.next
+}
+
+// messagesSinceTag returns the messages of the commits reachable from HEAD but
+// not from the latest tag, or all if there is no tag.
+func (gt *gitVersion) messagesSinceTag() ([]string, error) {
+	commits, err := gt.commitsBetween(gt.tagCommit, gt.head.Hash(), gt.config.FirstParent)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]string, len(commits))
+	for i, c := range commits {
+		msgs[i] = c.Message
+	}
+	return msgs, nil
+}
+
+// commitsBetween returns the commits reachable from to but not from, in breadth
+// first order.  A zero from returns all commits reachable from to.  If paths are
+// configured only commits touching them are returned.
+func (gt *gitVersion) commitsBetween(from, to plumbing.Hash, firstParent bool) ([]*object.Commit, error) {
+	exclude := map[plumbing.Hash]bool{}
+	if !from.IsZero() {
+		err := gt.walkCommits(from, nil, firstParent, func(c *object.Commit) error {
+			exclude[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var commits []*object.Commit
+	err := gt.walkCommits(to, exclude, firstParent, func(c *object.Commit) error {
+		ok, err := gt.touchesPaths(c, firstParent)
+		if ok {
+			commits = append(commits, c)
+		}
+		return err
+	})
+	return commits, err
+}
+
+// touchesPaths reports whether the commit changes any of the configured paths.
+// As with git log -- <path> a merge only does if it differs from all parents, or
+// the first if firstParent is set.
+func (gt *gitVersion) touchesPaths(c *object.Commit, firstParent bool) (bool, error) {
+	if len(gt.paths) == 0 {
+		return true, nil
+	}
+	cur, err := gt.pathHashes(c)
+	if err != nil {
+		return false, err
+	}
+	if c.NumParents() == 0 {
+		for _, h := range cur {
+			if !h.IsZero() {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	parents := c.ParentHashes
+	if firstParent {
+		parents = parents[:1]
+	}
+	for _, ph := range parents {
+		p, err := gt.r.CommitObject(ph)
+		if err != nil {
+			return false, err
+		}
+		prev, err := gt.pathHashes(p)
+		if err != nil {
+			return false, err
+		}
+		same := true
+		for i := range cur {
+			same = same && cur[i] == prev[i]
+		}
+		if same {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pathHashes returns the object hash of each configured path in the commit
+// tree.  The hash is zero if the path does not exist.
+func (gt *gitVersion) pathHashes(c *object.Commit) ([]plumbing.Hash, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]plumbing.Hash, len(gt.paths))
+	for i, p := range gt.paths {
+		if p == "." {
+			out[i] = tree.Hash
+			continue
+		}
+		if e, err := tree.FindEntry(p); err == nil {
+			out[i] = e.Hash
+		}
+	}
+	return out, nil
+}
+
+// walkCommits calls fn for each commit reachable from h in breadth first order.
+// Commits in the exclude set are not visited nor are those only reachable
+// through them.  If firstParent is set only the first parent of merges is
+// followed.
+func (gt *gitVersion) walkCommits(h plumbing.Hash, exclude map[plumbing.Hash]bool, firstParent bool, fn func(*object.Commit) error) error {
+	var (
+		seen  = map[plumbing.Hash]bool{}
+		queue = []plumbing.Hash{h}
+	)
+	for len(queue) > 0 {
+		h, queue = queue[0], queue[1:]
+		if seen[h] || exclude[h] {
+			continue
+		}
+		seen[h] = true
+		c, err := gt.r.CommitObject(h)
+		if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			if err == storer.ErrStop {
+				return nil
+			}
+			return err
+		}
+		parents := c.ParentHashes
+		if firstParent && len(parents) > 1 {
+			parents = parents[:1]
+		}
+		queue = append(queue, parents...)
+	}
+	return nil
+}
+
+// CreateTag creates an annotated tag of HEAD in the local repository.  The
+// tagger is read from GIT_COMMITTER_NAME/GIT_COMMITTER_EMAIL or the user section
+// of the repo config.
+func (gt *gitVersion) CreateTag(name, msg string) error {
+	if gt.r == nil || gt.head == nil {
+		return fmt.Errorf("not a git repository")
+	}
+	ref := plumbing.ReferenceName("refs/tags/" + name)
+	if _, err := gt.r.Reference(ref, false); err == nil {
+		return fmt.Errorf("tag already exists: %s", name)
+	}
+
+	tagger, err := gt.signature()
+	if err != nil {
+		return err
+	}
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     tagger,
+		Message:    msg + "\n",
+		TargetType: plumbing.CommitObject,
+		Target:     gt.head.Hash(),
+	}
+	obj := gt.r.Storer.NewEncodedObject()
+	if err = tag.Encode(obj); err != nil {
+		return err
+	}
+	h, err := gt.r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	return gt.r.Storer.SetReference(plumbing.NewHashReference(ref, h))
+}
+
+func (gt *gitVersion) signature() (object.Signature, error) {
+	sig := object.Signature{
+		Name:  os.Getenv("GIT_COMMITTER_NAME"),
+		Email: os.Getenv("GIT_COMMITTER_EMAIL"),
+		When:  time.Now(),
+	}
+	if cfg, err := gt.r.Config(); err == nil && cfg.Raw != nil {
+		if sig.Name == "" {
+			sig.Name = cfg.Raw.Section("user").Option("name")
+		}
+		if sig.Email == "" {
+			sig.Email = cfg.Raw.Section("user").Option("email")
+		}
+	}
+	if sig.Name == "" || sig.Email == "" {
+		return sig, fmt.Errorf("tagger unknown: set GIT_COMMITTER_NAME and GIT_COMMITTER_EMAIL")
+	}
+	return sig, nil
+}
+
+func (gt *gitVersion) info() versionInfo {
+	tv := gt.TagVersion()
+	return versionInfo{
+		Tag:      tv,
+		Distance: gt.distance,
+		Commit:   gt.Commit(),
+		Branch:   sanitizeBranch(gt.branch),
+		semver:   parseSemver(tv),
 	}
-	return fmt.Sprintf("%s-%d-%s", tv, gt.distance, cmt)
 }
 
 func (gt *gitVersion) initVersion() {
 	var err error
-	if gt.head, err = gt.r.Head(); err != nil {
-		return
+	if gt.head == nil {
+		if gt.head, err = gt.resolveHead(); err != nil {
+			return
+		}
+	}
+	if gt.head.IsBranch() {
+		gt.branch = gt.head.Name().Short()
+	} else if ci := detectCI(); ci != nil && gt.ref == "" {
+		gt.branch = ci.Info().Branch
 	}
 
 	gt.getTags()
+	if gt.ref == "" {
+		gt.dirty, _ = gt.isDirty()
+	}
 
 	err = gt.getLatestTag()
 	if err != nil {
@@ -87,6 +565,9 @@ func (gt *gitVersion) getTags() error {
 	}
 
 	iter.ForEach(func(arg1 *plumbing.Reference) error {
+		if !gt.config.matchTag(arg1.Name().Short()) {
+			return nil
+		}
 
 		if obj, err := gt.r.Object(plumbing.AnyObject, arg1.Hash()); err == nil {
 			switch obj.(type) {
@@ -106,23 +587,31 @@ func (gt *gitVersion) getTags() error {
 	return nil
 }
 
+// maximum number of tags considered when looking for the nearest as git
+// describe does by default
+const maxDescribeCandidates = 10
+
+// getLatestTag finds the nearest tag reachable from HEAD and the distance to it
+// with git describe semantics.  The nearest tag is the one with the fewest
+// commits reachable from HEAD but not from the tag, which is the distance.
 func (gt *gitVersion) getLatestTag() error {
-	if gt.head.IsTag() {
-		gt.latestTag = gt.head
+	hhash := gt.head.Hash()
+	if tag, ok := gt.tags[hhash]; ok {
+		gt.latestTag = tag
+		gt.tagCommit = hhash
 		gt.distance = 0
 		return nil
 	}
-	hhash := gt.head.Hash()
-	var thash plumbing.Hash
-	cIter, err := gt.r.Log(&git.LogOptions{From: hhash})
-	if err != nil {
-		return err
-	}
-	err = cIter.ForEach(func(c *object.Commit) error {
-		if tag, ok := gt.tags[c.Hash]; ok {
-			gt.latestTag = tag
-			thash = c.Hash
-			return storer.ErrStop
+
+	// tagged commits in breadth first order i.e. closest first
+	var (
+		candidates []plumbing.Hash
+		headCount  int
+	)
+	err := gt.walkCommits(hhash, nil, gt.config.FirstParent, func(c *object.Commit) error {
+		headCount++
+		if _, ok := gt.tags[c.Hash]; ok && len(candidates) < maxDescribeCandidates {
+			candidates = append(candidates, c.Hash)
 		}
 		return nil
 	})
@@ -130,41 +619,37 @@ func (gt *gitVersion) getLatestTag() error {
 		return err
 	}
 
-	d, err := gt.diffCommits(hhash, thash)
-	if err != nil {
-		return err
+	gt.distance = headCount
+	for _, h := range candidates {
+		n, err := gt.countCommits(h)
+		if err != nil {
+			return err
+		}
+		// first found wins a tie
+		if d := headCount - n; gt.latestTag == nil || d < gt.distance {
+			gt.latestTag = gt.tags[h]
+			gt.tagCommit = h
+			gt.distance = d
+		}
+	}
+
+	if len(gt.paths) > 0 {
+		// only count those touching the paths
+		commits, err := gt.commitsBetween(gt.tagCommit, hhash, gt.config.FirstParent)
+		if err != nil {
+			return err
+		}
+		gt.distance = len(commits)
 	}
-	gt.distance = d
 	return nil
 }
 
+// countCommits returns the number of commits reachable from h
 func (gt *gitVersion) countCommits(h plumbing.Hash) (int, error) {
-	if h.IsZero() {
-		return 0, nil
-	}
-	cIter, err := gt.r.Log(&git.LogOptions{From: h})
-	if err != nil {
-		return 0, err
-	}
 	n := 0
-	err = cIter.ForEach(func(c *object.Commit) error {
+	err := gt.walkCommits(h, nil, gt.config.FirstParent, func(c *object.Commit) error {
 		n++
 		return nil
 	})
 	return n, err
 }
-
-func (gt *gitVersion) diffCommits(from, to plumbing.Hash) (int, error) {
-	if from == to {
-		return 0, nil
-	}
-	n1, err := gt.countCommits(from)
-	if err != nil {
-		return 0, err
-	}
-	n2, err := gt.countCommits(to)
-	if err != nil {
-		return 0, err
-	}
-	return n1 - n2, nil
-}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 func Test_gitVersion(t *testing.T) {
@@ -34,3 +41,303 @@ func Test_gitTag(t *testing.T) {
 		t.Fatal("tag should be found")
 	}
 }
+
+// testRepo is a temporary git repository to test version computation
+type testRepo struct {
+	t   *testing.T
+	dir string
+	r   *git.Repository
+	n   int
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "mold-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{t: t, dir: dir, r: r}
+}
+
+func (tr *testRepo) cleanup() { os.RemoveAll(tr.dir) }
+
+// commit writes a new file and commits it returning the hash.  The parents
+// default to HEAD.  HEAD is moved to the new commit.
+func (tr *testRepo) commit(msg string, parents ...plumbing.Hash) plumbing.Hash {
+	return tr.commitFile(fmt.Sprintf("file%d", tr.n+1), msg, parents...)
+}
+
+// commitFile writes the file, relative to the repo, and commits it
+func (tr *testRepo) commitFile(name, msg string, parents ...plumbing.Hash) plumbing.Hash {
+	tr.n++
+	fpath := filepath.Join(tr.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		tr.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fpath, []byte(fmt.Sprintf("%s %d", msg, tr.n)), 0644); err != nil {
+		tr.t.Fatal(err)
+	}
+	wt, err := tr.r.Worktree()
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	if _, err = wt.Add(name); err != nil {
+		tr.t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now().Add(time.Duration(tr.n) * time.Second)}
+	h, err := wt.Commit(msg, &git.CommitOptions{Author: sig, Committer: sig, Parents: parents})
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return h
+}
+
+// tag creates a lightweight tag
+func (tr *testRepo) tag(name string, h plumbing.Hash) {
+	ref := plumbing.NewHashReference(plumbing.ReferenceName("refs/tags/"+name), h)
+	if err := tr.r.Storer.SetReference(ref); err != nil {
+		tr.t.Fatal(err)
+	}
+}
+
+func (tr *testRepo) version() *gitVersion {
+	return tr.versionWithConfig(VersionConfig{})
+}
+
+func (tr *testRepo) versionWithConfig(cfg VersionConfig) *gitVersion {
+	return tr.versionIn(".", cfg)
+}
+
+// versionIn returns the version of the project in the repo relative dir
+func (tr *testRepo) versionIn(dir string, cfg VersionConfig) *gitVersion {
+	if err := cfg.parse(); err != nil {
+		tr.t.Fatal(err)
+	}
+	gt, err := newGitVersionWithConfig(filepath.Join(tr.dir, dir), cfg)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return gt
+}
+
+func Test_gitVersion_NextVersion(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+
+	tr.tag("v1.2.3", tr.commit("initial"))
+	if v := tr.version().NextVersion(); v != "1.2.3" {
+		t.Fatal("tagged commit should be the tag:", v)
+	}
+
+	tr.commit("fix: bug")
+	if v := tr.version().NextVersion(); v != "1.2.4" {
+		t.Fatal("want patch bump:", v)
+	}
+	tr.commit("feat(api): new endpoint")
+	if v := tr.version().NextVersion(); v != "1.3.0" {
+		t.Fatal("want minor bump:", v)
+	}
+	tr.commit("refactor!: drop v1")
+	if v := tr.version().NextVersion(); v != "2.0.0" {
+		t.Fatal("want major bump:", v)
+	}
+
+	tr.tag("v2.0.0", tr.commit("chore: release"))
+	tr.commit("docs: readme")
+	if v := tr.version().NextVersion(); v != "2.0.1" {
+		t.Fatal("only commits since the tag should count:", v)
+	}
+}
+
+func Test_gitVersion_CreateTag(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.tag("v0.1.0", tr.commit("initial"))
+	h := tr.commit("feat: thing")
+
+	os.Setenv("GIT_COMMITTER_NAME", "test")
+	os.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	defer os.Unsetenv("GIT_COMMITTER_NAME")
+	defer os.Unsetenv("GIT_COMMITTER_EMAIL")
+
+	gt := tr.version()
+	tag, err := releaseTag(gt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != "v0.2.0" {
+		t.Fatal("wrong tag", tag)
+	}
+	if err = gt.CreateTag(tag, "Release "+tag); err != nil {
+		t.Fatal(err)
+	}
+	if err = gt.CreateTag(tag, "Release "+tag); err == nil {
+		t.Fatal("should fail if the tag exists")
+	}
+
+	gt = tr.version()
+	if gt.Version() != "0.2.0" || gt.getTag(h.String()) != "v0.2.0" {
+		t.Fatal("tag not found", gt.Version())
+	}
+	if _, err = releaseTag(gt); err == nil {
+		t.Fatal("should fail when already released")
+	}
+}
+
+func Test_gitVersion_describe(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+
+	if gt := tr.version(); gt.TagVersion() != "0.0.0" {
+		t.Fatal("empty repo should be 0.0.0")
+	}
+
+	// A(v1.0.0) - B - C
+	a := tr.commit("a")
+	tr.tag("v1.0.0", a)
+	tr.commit("b")
+	tr.commit("c")
+	if gt := tr.version(); gt.Version() != "1.0.0-2-"+gt.Commit() {
+		t.Fatal("linear:", gt.Version())
+	}
+
+	//   A - M1(v1.1.0) ---- MERGE
+	//    \                  /
+	//     F1 - F2 ---------
+	tr = newTestRepo(t)
+	defer tr.cleanup()
+	a = tr.commit("a")
+	tr.tag("v1.0.0", a)
+	f1 := tr.commit("f1", a)
+	f2 := tr.commit("f2", f1)
+	m1 := tr.commit("m1", a)
+	tr.tag("v1.1.0", m1)
+	tr.commit("merge", m1, f2)
+
+	gt := tr.version()
+	if gt.TagVersion() != "1.1.0" || gt.distance != 3 {
+		t.Fatal("merge:", gt.TagVersion(), gt.distance)
+	}
+	gt = tr.versionWithConfig(VersionConfig{FirstParent: true})
+	if gt.TagVersion() != "1.1.0" || gt.distance != 1 {
+		t.Fatal("merge first parent:", gt.TagVersion(), gt.distance)
+	}
+	gt = tr.versionWithConfig(VersionConfig{Match: "v1.0.*"})
+	if gt.TagVersion() != "1.0.0" || gt.distance != 4 {
+		t.Fatal("match:", gt.TagVersion(), gt.distance)
+	}
+
+	//   A(v1.0.0) - B ------- MERGE
+	//    \                    /
+	//     F1(v1.1.0-rc.1) ---
+	tr = newTestRepo(t)
+	defer tr.cleanup()
+	a = tr.commit("a")
+	tr.tag("v1.0.0", a)
+	f1 = tr.commit("f1", a)
+	tr.tag("v1.1.0-rc.1", f1)
+	b := tr.commit("b", a)
+	tr.commit("merge", b, f1)
+
+	gt = tr.version()
+	if gt.TagVersion() != "1.1.0-rc.1" || gt.distance != 2 {
+		t.Fatal("side branch tag:", gt.TagVersion(), gt.distance)
+	}
+	gt = tr.versionWithConfig(VersionConfig{FirstParent: true})
+	if gt.TagVersion() != "1.0.0" || gt.distance != 2 {
+		t.Fatal("side branch tag first parent:", gt.TagVersion(), gt.distance)
+	}
+}
+
+func Test_gitVersion_monorepo(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+
+	tr.tag("api/v1.4.0", tr.commitFile("api/main.go", "feat: api"))
+	tr.tag("web/v2.0.1", tr.commitFile("web/index.html", "feat: web"))
+	tr.commitFile("api/main.go", "fix(api): bug")
+	tr.commitFile("web/index.html", "feat(web): page")
+	tr.commitFile("web/index.html", "fix(web): typo")
+
+	api := VersionConfig{Prefix: "api/v", Paths: []string{"."}}
+	gt := tr.versionIn("api", api)
+	if gt.TagVersion() != "1.4.0" || gt.distance != 1 {
+		t.Fatal("api:", gt.TagVersion(), gt.distance)
+	}
+	if v := gt.NextVersion(); v != "1.4.1" {
+		t.Fatal("api next version should only consider its commits:", v)
+	}
+	if tag, err := releaseTag(gt); err != nil || tag != "api/v1.4.1" {
+		t.Fatal("api release tag:", tag, err)
+	}
+
+	gt = tr.versionIn("web", VersionConfig{Prefix: "web/v", Paths: []string{"."}})
+	if gt.TagVersion() != "2.0.1" || gt.distance != 2 || gt.NextVersion() != "2.1.0" {
+		t.Fatal("web:", gt.TagVersion(), gt.distance, gt.NextVersion())
+	}
+
+	// without paths all commits since the tag count
+	gt = tr.versionIn("api", VersionConfig{Prefix: "api/v"})
+	if gt.distance != 4 {
+		t.Fatal("api all commits:", gt.distance)
+	}
+
+	// untouched since the tag is the tag
+	tr.tag("api/v1.4.1", tr.commitFile("api/main.go", "fix(api): other"))
+	tr.commitFile("web/index.html", "fix(web): more")
+	if gt = tr.versionIn("api", api); gt.Version() != "1.4.1" {
+		t.Fatal("api untouched:", gt.Version())
+	}
+
+	if _, err := newGitVersionWithConfig(filepath.Join(tr.dir, "api"), VersionConfig{Paths: []string{"../../x"}}); err == nil {
+		t.Fatal("should fail with path outside of the repo")
+	}
+}
+
+func Test_gitVersion_dirty(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.commitFile("api/main.go", "api")
+	tr.tag("v1.0.0", tr.commitFile("web/index.html", "web"))
+
+	gt := tr.versionWithConfig(VersionConfig{})
+	if gt.Dirty() || gt.Version() != "1.0.0" {
+		t.Fatal("should be clean:", gt.Version())
+	}
+
+	// untracked files do not count
+	ioutil.WriteFile(filepath.Join(tr.dir, "new.txt"), []byte("x"), 0644)
+	if gt = tr.versionWithConfig(VersionConfig{}); gt.Dirty() {
+		t.Fatal("untracked should not be dirty")
+	}
+
+	ioutil.WriteFile(filepath.Join(tr.dir, "web", "index.html"), []byte("changed"), 0644)
+	if gt = tr.versionWithConfig(VersionConfig{}); !gt.Dirty() || gt.Version() != "1.0.0-dirty" {
+		t.Fatal("should be dirty:", gt.Version())
+	}
+	// without a mold file
+	if gt, err := newGitVersion(tr.dir); err != nil || gt.Version() != "1.0.0-dirty" {
+		t.Fatal("should default the suffix:", err)
+	}
+	if gt = tr.versionWithConfig(VersionConfig{DirtySuffix: ".wip"}); gt.Version() != "1.0.0.wip" {
+		t.Fatal("wrong suffix:", gt.Version())
+	}
+
+	// changes outside of the paths do not count
+	if gt = tr.versionIn("api", VersionConfig{Paths: []string{"."}}); gt.Dirty() {
+		t.Fatal("api should be clean")
+	}
+
+	mc := &MoldConfig{gitVersion: gt}
+	mc.gitVersion.dirty = true
+	if err := checkDirty(mc); err == nil {
+		t.Fatal("should not allow publishing dirty")
+	}
+	mc.Artifacts.AllowDirty = true
+	if err := checkDirty(mc); err != nil {
+		t.Fatal(err)
+	}
+}
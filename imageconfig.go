@@ -12,13 +12,28 @@ type ImageConfig struct {
 	Dockerfile string `yaml:",omitempty"`
 	// whether to enable the no-cache option in docker build
 	CachedBuild bool `yaml:"cache,omitempty" json:"cache"`
+	// Images used as layer cache sources.  Defaults to the registry paths of
+	// the image when the cache is enabled.
+	CacheFrom []string `yaml:"cache_from,omitempty" json:"cache_from,omitempty"`
 	// Additional tags to be applied to the image on top of the default 'latest'
 	Tags []string `yaml:",omitempty"`
 
-	Registry  string `yaml:",omitempty"`
+	Registry string `yaml:",omitempty"`
+	// Registries the image is published to each with its own tags and publish
+	// conditions.  Registry is ignored if set.
+	Registries []RegistryConfig `yaml:",omitempty"`
+	// Publish overrides the branches/tags of the artifacts the image is
+	// published on
+	Publish []string `yaml:",omitempty"`
+	// Promote are the registries and tags a published version of the image is
+	// pushed to by the promote target.  Tags default to the version.
+	Promote []RegistryConfig `yaml:",omitempty"`
+
 	Context   string `yaml:",omitempty"` // working directory, url etc.
 	CleanUp   bool   `yaml:",omitempty"`
 	baseimage string
+	// cache sources available locally to pass to the build
+	cacheFrom []string
 
 	id string
 }
@@ -33,14 +48,74 @@ func (ic *ImageConfig) Validate() error {
 		return fmt.Errorf("cannot specify tags in name and tags")
 	}
 
+	for _, rc := range ic.Registries {
+		if strings.Contains(ic.Name, ":") && len(rc.Tags) > 0 {
+			return fmt.Errorf("cannot specify tags in name and registry tags: %s", ic.Name)
+		}
+	}
+
+	if strings.Contains(ic.Name, ":") && len(ic.Promote) > 0 {
+		return fmt.Errorf("cannot specify tags in name and promote: %s", ic.Name)
+	}
+
+	if len(ic.CacheFrom) > 0 && !ic.CachedBuild {
+		return fmt.Errorf("cache_from requires cache to be enabled: %s", ic.Name)
+	}
+
 	return nil
 }
 
 // ReplaceTagVars replaces any instances of the placeholder found in tags with the supplied value.
+// A '+' in the value, i.e. semver build metadata, is replaced by '-' as it is
+// not valid in a docker tag.
 func (ic *ImageConfig) ReplaceTagVars(placeholder, value string) {
+	value = tagValue(value)
 	for i, tag := range ic.Tags {
 		ic.Tags[i] = strings.Replace(tag, placeholder, value, -1)
 	}
+	for i, ref := range ic.CacheFrom {
+		ic.CacheFrom[i] = strings.Replace(ref, placeholder, value, -1)
+	}
+	for i := range ic.Registries {
+		for j, tag := range ic.Registries[i].Tags {
+			ic.Registries[i].Tags[j] = strings.Replace(tag, placeholder, value, -1)
+		}
+	}
+}
+
+// tagValue returns the value usable in a docker tag
+func tagValue(value string) string {
+	return strings.Replace(value, "+", "-", -1)
+}
+
+// ReplacePublishVars replaces any instances of the placeholder found in the
+// publish conditions of the image and its registries.
+func (ic *ImageConfig) ReplacePublishVars(placeholder, value string) {
+	for i, p := range ic.Publish {
+		ic.Publish[i] = strings.Replace(p, placeholder, value, -1)
+	}
+	for i := range ic.Registries {
+		for j, p := range ic.Registries[i].Publish {
+			ic.Registries[i].Publish[j] = strings.Replace(p, placeholder, value, -1)
+		}
+	}
+}
+
+// CacheFromRefs returns the images to use as layer cache sources.  None are
+// returned if the cache is disabled.  The registry paths are only the default
+// when a registry is configured, an image only named would be pulled from the
+// docker hub where it is likely someone else's.
+func (ic *ImageConfig) CacheFromRefs() []string {
+	if !ic.CachedBuild {
+		return nil
+	}
+	if len(ic.CacheFrom) > 0 {
+		return ic.CacheFrom
+	}
+	if len(ic.Registry) == 0 && len(ic.Registries) == 0 {
+		return nil
+	}
+	return ic.RegistryPaths()
 }
 
 // DefaultRegistryPaths return the default (i.e. docker) registry paths
@@ -67,12 +142,125 @@ func (ic *ImageConfig) CustomRegistryPaths() []string {
 	return paths
 }
 
+// RegistryPaths returns the paths of the image in all the registries it is
+// published to
 func (ic *ImageConfig) RegistryPaths() []string {
-	// if not registry specified return default docker registry
-	if len(ic.Registry) == 0 {
-		return ic.DefaultRegistryPaths()
+	if len(ic.Registries) == 0 {
+		// if not registry specified return default docker registry
+		if len(ic.Registry) == 0 {
+			return ic.DefaultRegistryPaths()
+		}
+		return ic.CustomRegistryPaths()
+	}
+
+	var paths []string
+	for _, rc := range ic.PublishTargets() {
+		paths = appendUnique(paths, rc.Paths(ic.Name)...)
+	}
+	return paths
+}
+
+// BuildTags returns the local and registry paths the image is tagged with
+func (ic *ImageConfig) BuildTags() []string {
+	return appendUnique(ic.DefaultRegistryPaths(), ic.RegistryPaths()...)
+}
+
+// PublishTargets returns the registries the image is published to.  The
+// registry, tags and publish conditions of the image are used if no registries
+// are configured or as the defaults of those that are.
+func (ic *ImageConfig) PublishTargets() []RegistryConfig {
+	if len(ic.Registries) == 0 {
+		return []RegistryConfig{{Registry: ic.Registry, Publish: ic.Publish, tags: ic.Tags}}
+	}
+
+	targets := make([]RegistryConfig, len(ic.Registries))
+	for i, rc := range ic.Registries {
+		if rc.Publish == nil {
+			rc.Publish = ic.Publish
+		}
+		if rc.tags = rc.Tags; rc.tags == nil {
+			rc.tags = ic.Tags
+		}
+		targets[i] = rc
+	}
+	return targets
+}
+
+// PromoteSource returns the reference of the published version of the image.
+// It is in the first registry the image is published to.
+func (ic *ImageConfig) PromoteSource(version string) (registry, ref string) {
+	rc := ic.PublishTargets()[0]
+	ref = ic.Name + ":" + tagValue(version)
+	if rc.Registry != "" {
+		ref = rc.Registry + "/" + ref
+	}
+	return rc.Registry, ref
+}
+
+// PromoteTargets returns the registries the version is promoted to with the
+// ${APP_VERSION} in tags replaced by the version.
+func (ic *ImageConfig) PromoteTargets(version string) []RegistryConfig {
+	version = tagValue(version)
+	targets := make([]RegistryConfig, len(ic.Promote))
+	for i, rc := range ic.Promote {
+		tags := []string{version}
+		if len(rc.Tags) > 0 {
+			tags = make([]string, len(rc.Tags))
+			for j, tag := range rc.Tags {
+				tags[j] = strings.Replace(tag, "${APP_VERSION}", version, -1)
+			}
+		}
+		targets[i] = RegistryConfig{Registry: rc.Registry, Tags: tags}
+	}
+	return targets
+}
+
+// RegistryConfig is a registry an image is published to
+type RegistryConfig struct {
+	Registry string   `yaml:",omitempty"` // blank is docker hub
+	Tags     []string `yaml:",omitempty"` // only these tags if set
+	Publish  []string `yaml:",omitempty"` // branches/tags published on
+
+	// tags defaulting to those of the image
+	tags []string
+}
+
+// Paths returns the paths of the image in the registry.  These are the tags of
+// the registry if set, otherwise latest and the tags of the image.
+func (rc RegistryConfig) Paths(name string) []string {
+	prefix := name
+	if rc.Registry != "" {
+		prefix = rc.Registry + "/" + name
+	}
+
+	var paths []string
+	tags := rc.tags
+	if rc.Tags == nil {
+		paths = append(paths, prefix)
+	} else {
+		tags = rc.Tags
+	}
+	for _, tag := range tags {
+		paths = appendUnique(paths, prefix+":"+tag)
+	}
+	return paths
+}
+
+// appendUnique appends the values not in the slice already
+func appendUnique(s []string, vals ...string) []string {
+	for _, v := range vals {
+		found := false
+		for _, e := range s {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
 	}
-	return ic.CustomRegistryPaths()
+	return s
 }
 
 /*// RegistryPath return the full image path to the registry
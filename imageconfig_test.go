@@ -45,3 +45,68 @@ func Test_RegistryPaths(t *testing.T) {
 		t.Fatalf("should be custom registry path")
 	}
 }
+
+func Test_ImageConfig_CacheFromRefs(t *testing.T) {
+	ic := ImageConfig{Name: "name", Registry: "registry", Tags: []string{"v1"}}
+	if refs := ic.CacheFromRefs(); refs != nil {
+		t.Fatal("should be empty when cache disabled", refs)
+	}
+
+	ic.CachedBuild = true
+	if refs := ic.CacheFromRefs(); strings.Join(refs, ",") != "registry/name,registry/name:v1" {
+		t.Fatal("should default to registry paths", refs)
+	}
+
+	unpublished := ImageConfig{Name: "name", Tags: []string{"v1"}, CachedBuild: true}
+	if refs := unpublished.CacheFromRefs(); refs != nil {
+		t.Fatal("should not default to the docker hub", refs)
+	}
+
+	ic.CacheFrom = []string{"other:${REPLACE}"}
+	ic.ReplaceTagVars("${REPLACE}", "1.1.1")
+	if refs := ic.CacheFromRefs(); strings.Join(refs, ",") != "other:1.1.1" {
+		t.Fatal("wrong refs", refs)
+	}
+
+	semver := ImageConfig{Name: "name", Tags: []string{"${APP_VERSION}"}}
+	semver.ReplaceTagVars("${APP_VERSION}", "1.2.4-dev.5+abcdef0")
+	if semver.Tags[0] != "1.2.4-dev.5-abcdef0" {
+		t.Fatal("build metadata should be sanitized in tags", semver.Tags)
+	}
+
+	ic.CachedBuild = false
+	if err := ic.Validate(); err == nil {
+		t.Fatal("should fail without cache")
+	}
+}
+
+func Test_ImageConfig_Registries(t *testing.T) {
+	ic := ImageConfig{
+		Name: "name",
+		Tags: []string{"${REPLACE}"},
+		Registries: []RegistryConfig{
+			{Registry: "staging", Tags: []string{"latest"}},
+			{Registry: "prod", Publish: []string{"^v${REPLACE}$"}},
+		},
+	}
+	if err := ic.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ic.ReplaceTagVars("${REPLACE}", "1.1.1")
+	ic.ReplacePublishVars("${REPLACE}", "1.1.1")
+
+	if paths := strings.Join(ic.RegistryPaths(), ","); paths != "staging/name:latest,prod/name,prod/name:1.1.1" {
+		t.Fatal("wrong registry paths", paths)
+	}
+	if tags := strings.Join(ic.BuildTags(), ","); tags != "name,name:1.1.1,staging/name:latest,prod/name,prod/name:1.1.1" {
+		t.Fatal("wrong build tags", tags)
+	}
+	if pub := ic.Registries[1].Publish[0]; pub != "^v1.1.1$" {
+		t.Fatal("publish var not replaced", pub)
+	}
+
+	ic.Name = "name:v1"
+	if err := ic.Validate(); err == nil {
+		t.Fatal("should fail with tags in name and registry")
+	}
+}
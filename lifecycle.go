@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"regexp"
+	"sync"
+	"time"
 )
 
+// default time allowed for teardown to complete regardless of the run context.
+const defaultTeardownTimeout = 2 * time.Minute
+
 // LifeCyclePhase represents a phase in the lifecycle
 type LifeCyclePhase string
 
@@ -18,18 +23,39 @@ const (
 	lifeCyleArtifacts  LifeCyclePhase = "artifacts" // lifeCyleArtifacts builds specified docker images
 	lifeCyclePublish   LifeCyclePhase = "publish"   // lifeCyclePublish pushes the docker images up to a registry
 	lifeCycleTeardown  LifeCyclePhase = "teardown"  // lifeCycleTeardown cleans up resources created during the build.
+
+	lifeCycleCache   LifeCyclePhase = "cache"   // lifeCycleCache is not a phase but a target to manage build caches
+	lifeCycleRelease LifeCyclePhase = "release" // lifeCycleRelease runs the lifecycle then tags the next version
+	lifeCyclePromote LifeCyclePhase = "promote" // lifeCyclePromote pushes a published version to other registries
+	lifeCycleExport  LifeCyclePhase = "export"  // lifeCycleExport saves the artifacts as files
 )
 
 // Worker perform all work for a given job.  This would be implemented
-// based on the backend used - in the current case docker.
+// based on the backend used - in the current case docker.  The supplied context
+// is scoped to the run and is cancelled when the lifecycle is aborted.
 type Worker interface {
-	Configure(*MoldConfig) error       // Initialize underlying needed structs
-	Setup() error                      // Statisfy deps needed for the build
-	Build() error                      // Build required data to be package
-	GenerateArtifacts(...string) error // Package data to an artifact.
-	Publish(...string) error           // Publish the generated artifacts
-	Teardown() error
-	Abort() error
+	Configure(*MoldConfig) error                        // Initialize underlying needed structs
+	Setup(context.Context) error                        // Statisfy deps needed for the build
+	Build(context.Context) error                        // Build required data to be package
+	GenerateArtifacts(context.Context, ...string) error // Package data to an artifact.
+	Publish(context.Context, ...string) error           // Publish the generated artifacts
+	Teardown(context.Context) error                     // Cleanup. Called with its own bounded context
+}
+
+// CacheManager is implemented by workers that persist build caches
+type CacheManager interface {
+	ListCaches(context.Context, io.Writer) error
+	PruneCaches(context.Context, io.Writer) error
+}
+
+// Promoter is implemented by workers that can promote published artifacts
+type Promoter interface {
+	Promote(ctx context.Context, version string) error
+}
+
+// Exporter is implemented by workers that can save artifacts as files
+type Exporter interface {
+	Export(ctx context.Context, names ...string) error
 }
 
 // LifeCycle manages the complete lifecyle
@@ -37,6 +63,9 @@ type LifeCycle struct {
 	worker Worker
 	cfg    *MoldConfig
 	log    io.Writer
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // cancels the context of the current run
 }
 
 // NewLifeCycle with stdout as the logger with the provided worker
@@ -47,6 +76,9 @@ func NewLifeCycle(worker Worker) *LifeCycle {
 // Run the complete lifecyle
 func (lc *LifeCycle) Run(cfg *MoldConfig) error {
 
+	ctx, cancel := lc.runContext()
+	defer cancel()
+
 	err := lc.worker.Configure(cfg)
 	if err != nil {
 		return err
@@ -54,67 +86,128 @@ func (lc *LifeCycle) Run(cfg *MoldConfig) error {
 	lc.cfg = cfg
 	lc.printStartSummary()
 
-	if err = lc.worker.Setup(); err == nil {
-		if err = lc.worker.Build(); err == nil {
-			if err = lc.worker.GenerateArtifacts(); err == nil {
-				if lc.shouldPublishArtifacts() {
-					err = lc.worker.Publish()
-				} else {
+	if err = lc.worker.Setup(ctx); err == nil {
+		if err = lc.worker.Build(ctx); err == nil {
+			if err = lc.worker.GenerateArtifacts(ctx); err == nil {
+				if !lc.shouldPublishArtifacts() {
 					lc.log.Write([]byte("[publish] Not publishing. Criteria not met.\n"))
+				} else if err = checkDirty(cfg); err != nil {
+					lc.log.Write([]byte("[publish] Not publishing. " + err.Error() + "\n"))
+				} else {
+					err = lc.worker.Publish(ctx)
 				}
 			}
 		}
 	}
-	if e := lc.worker.Teardown(); e != nil {
-		log.Printf("ERR [Teardown] %v", e)
-	}
+	lc.teardown()
 
 	return err
 }
 
-// whether to publish the image based on the branch/tag
-func (lc *LifeCycle) shouldPublishArtifacts() bool {
-	arts := lc.cfg.Artifacts
-	for _, p := range arts.Publish {
-		if p == lc.cfg.BranchTag {
-			return true
-		}
-		if m, err := regexp.MatchString(p, lc.cfg.BranchTag); err == nil {
-			if m {
-				return true
-			}
-		}
+// runContext returns a new context for a run.  The context is cancelled on Abort.
+func (lc *LifeCycle) runContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.mu.Lock()
+	lc.cancel = cancel
+	lc.mu.Unlock()
+	return ctx, cancel
+}
+
+// teardown runs the worker teardown with its own bounded context so cleanup
+// happens even if the run was aborted.
+func (lc *LifeCycle) teardown() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTeardownTimeout)
+	defer cancel()
+	if e := lc.worker.Teardown(ctx); e != nil {
+		log.Printf("ERR [%s] %v", lifeCycleTeardown, e)
 	}
-	return false
 }
 
-// Abort the lifecyle ending it.
+// whether to publish any image based on the branch/tag
+func (lc *LifeCycle) shouldPublishArtifacts() bool {
+	refs, err := lc.cfg.Artifacts.PublishRefs(lc.cfg.BranchTag)
+	return err == nil && len(refs) > 0 || lc.cfg.Artifacts.exports(lc.cfg.BranchTag)
+}
+
+// Abort the lifecyle ending it.  This cancels the context of the current run
+// interrupting any in-flight operation.
 func (lc *LifeCycle) Abort() error {
-	return lc.worker.Abort()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.cancel == nil {
+		return fmt.Errorf("not running")
+	}
+	lc.cancel()
+	return nil
 }
 
 // RunTarget runs a specified target in the lifecyle
 func (lc *LifeCycle) RunTarget(cfg *MoldConfig, target LifeCyclePhase, args ...string) error {
+	ctx, cancel := lc.runContext()
+	defer cancel()
+
 	var err error
 	switch target {
 	case lifeCycleBuild:
 		if err = lc.worker.Configure(cfg); err == nil {
-			if err = lc.worker.Setup(); err == nil {
-				err = lc.worker.Build()
+			if err = lc.worker.Setup(ctx); err == nil {
+				err = lc.worker.Build(ctx)
 			}
 		}
-		if e := lc.worker.Teardown(); e != nil {
-			log.Printf("ERR [%s] %v", lifeCycleTeardown, e)
-		}
+		lc.teardown()
 
 	case lifeCyleArtifacts:
 		if err = lc.worker.Configure(cfg); err == nil {
-			err = lc.worker.GenerateArtifacts(args...)
+			err = lc.worker.GenerateArtifacts(ctx, args...)
 		}
 
 	case lifeCyclePublish:
+		if err = checkDirty(cfg); err != nil {
+			break
+		}
 		if err = lc.worker.Configure(cfg); err == nil {
-			err = lc.worker.Publish(args...)
+			err = lc.worker.Publish(ctx, args...)
+		}
+
+	case lifeCycleCache:
+		if err = lc.worker.Configure(cfg); err == nil {
+			err = lc.runCacheCommand(ctx, args...)
+		}
+
+	case lifeCycleExport:
+		ex, ok := lc.worker.(Exporter)
+		if !ok {
+			err = fmt.Errorf("export not supported by worker")
+			break
+		}
+		if err = lc.worker.Configure(cfg); err == nil {
+			err = ex.Export(ctx, args...)
+		}
+
+	case lifeCyclePromote:
+		pr, ok := lc.worker.(Promoter)
+		if !ok {
+			err = fmt.Errorf("promote not supported by worker")
+			break
+		}
+		var version string
+		if len(args) > 0 {
+			version = args[0]
+		}
+		if err = lc.worker.Configure(cfg); err == nil {
+			err = pr.Promote(ctx, version)
+		}
+
+	case lifeCycleRelease:
+		// check before running so nothing is built if there is nothing to release
+		var tag string
+		if err = checkDirty(cfg); err != nil {
+			break
+		}
+		if tag, err = releaseTag(cfg.gitVersion); err == nil {
+			if err = lc.Run(cfg); err == nil {
+				err = lc.release(tag)
+			}
 		}
 
 	default:
@@ -124,6 +217,57 @@ func (lc *LifeCycle) RunTarget(cfg *MoldConfig, target LifeCyclePhase, args ...s
 	return err
 }
 
+// runCacheCommand runs a cache sub command i.e. ls or prune.  It defaults to ls
+func (lc *LifeCycle) runCacheCommand(ctx context.Context, args ...string) error {
+	cm, ok := lc.worker.(CacheManager)
+	if !ok {
+		return fmt.Errorf("caches not supported by worker")
+	}
+
+	cmd := "ls"
+	if len(args) > 0 && args[0] != "" {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "ls":
+		return cm.ListCaches(ctx, lc.log)
+	case "prune":
+		return cm.PruneCaches(ctx, lc.log)
+	}
+	return fmt.Errorf("invalid cache command: %s", cmd)
+}
+
+// checkDirty returns an error if the working tree has uncommitted changes and
+// publishing from it is not allowed.
+func checkDirty(cfg *MoldConfig) error {
+	if cfg.gitVersion != nil && cfg.gitVersion.Dirty() && !cfg.Artifacts.AllowDirty {
+		return fmt.Errorf("working tree has uncommitted changes (use -allow-dirty to override)")
+	}
+	return nil
+}
+
+// releaseTag returns the name of the tag for the next version
+func releaseTag(gv *gitVersion) (string, error) {
+	if gv.latestTag != nil && gv.distance == 0 {
+		return "", fmt.Errorf("already released: %s", gv.latestTag.Name().Short())
+	}
+	next := gv.NextVersion()
+	if next == "" {
+		return "", fmt.Errorf("cannot determine the next version from tag: %s", gv.TagVersion())
+	}
+	return gv.config.tagPrefix() + next, nil
+}
+
+// release tags HEAD with the next version inferred from the commits
+func (lc *LifeCycle) release(tag string) error {
+	gv := lc.cfg.gitVersion
+	if err := gv.CreateTag(tag, "Release "+tag); err != nil {
+		return err
+	}
+	lc.log.Write([]byte(fmt.Sprintf("[%s] Tagged %s %s\n", lifeCycleRelease, gv.Commit(), tag)))
+	return nil
+}
+
 func (lc *LifeCycle) printStartSummary() {
 	c := lc.cfg
 	lc.log.Write([]byte(fmt.Sprintf(`
@@ -131,10 +275,11 @@ Name       : %s
 Version    : %s
 Branch/Tag : %s
 Repo       : %s
+CI         : %s
 
 Services   : %d
 Builds     : %d
 Artifacts  : %d
 
-`, c.Name(), c.gitVersion.Version(), c.BranchTag, c.RepoURL, len(c.Services), len(c.Build), len(c.Artifacts.Images))))
+`, c.Name(), c.gitVersion.Version(), c.BranchTag, c.RepoURL, c.ciSummary(), len(c.Services), len(c.Build), len(c.Artifacts.Images))))
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,7 +20,7 @@ func Test_LifeCycle_Run(t *testing.T) {
 		t.Fatal(err)
 	}
 	dw := lc.worker.(*DockerWorker)
-	dw.RemoveArtifacts()
+	dw.RemoveArtifacts(context.Background())
 }
 
 func Test_LifeCycle_buildless(t *testing.T) {
@@ -30,7 +34,7 @@ func Test_LifeCycle_buildless(t *testing.T) {
 		t.Fatal(err)
 	}
 	dw := lc.worker.(*DockerWorker)
-	dw.RemoveArtifacts()
+	dw.RemoveArtifacts(context.Background())
 }
 
 func Test_LifeCycle_fail(t *testing.T) {
@@ -56,17 +60,19 @@ func Test_LifeCycle_Abort(t *testing.T) {
 	mc.RepoName += "-test4"
 
 	lc := NewLifeCycle(worker)
+	abortCh := make(chan error, 1)
 	go func() {
 		<-time.After(2750 * time.Millisecond)
-		if err := lc.Abort(); err != nil {
-			t.Fatal(err)
-		}
+		abortCh <- lc.Abort()
 	}()
 
-	if err := lc.Run(mc); err != nil {
+	// an abort during setup is the error of the cancelled context
+	if err := lc.Run(mc); err == nil {
+		t.Fatal("should fail when aborted")
+	}
+	if err := <-abortCh; err != nil {
 		t.Fatal(err)
 	}
-
 }
 
 func Test_LifeCycle_RunTarget(t *testing.T) {
@@ -127,8 +133,8 @@ func Test_LifeCycle_moldenv(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	if len(envVals) != 8 {
-		t.Fatalf("environment values: want 8; have %d\n", len(envVals))
+	if len(envVals) != 10 {
+		t.Fatalf("environment values: want 10; have %d\n", len(envVals))
 	}
 }
 
@@ -139,11 +145,69 @@ func Test_LifeCycle_CleanUp(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := worker.getImageID("test-image:0.1.0"); err == nil {
+	if _, err := worker.getImageID(context.Background(), "test-image:0.1.0"); err == nil {
 		t.Fatal("should fail with \"image not found\"")
 	}
 
-	if _, err := worker.getImageID("test-image:0.1.1"); err != nil {
+	if _, err := worker.getImageID(context.Background(), "test-image:0.1.1"); err != nil {
 		t.Fatal("should return image id, returned: ", err.Error())
 	}
 }
+
+// stubWorker records the phases run without doing any work
+type stubWorker struct {
+	phases []string
+}
+
+func (sw *stubWorker) Configure(*MoldConfig) error { return nil }
+func (sw *stubWorker) Setup(context.Context) error {
+	sw.phases = append(sw.phases, "setup")
+	return nil
+}
+func (sw *stubWorker) Build(context.Context) error {
+	sw.phases = append(sw.phases, "build")
+	return nil
+}
+func (sw *stubWorker) GenerateArtifacts(context.Context, ...string) error {
+	sw.phases = append(sw.phases, "artifacts")
+	return nil
+}
+func (sw *stubWorker) Publish(context.Context, ...string) error {
+	sw.phases = append(sw.phases, "publish")
+	return nil
+}
+func (sw *stubWorker) Teardown(context.Context) error {
+	sw.phases = append(sw.phases, "teardown")
+	return nil
+}
+
+func Test_LifeCycle_Run_dirty(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.tag("v1.0.0", tr.commitFile("main.go", "init"))
+	ioutil.WriteFile(filepath.Join(tr.dir, "main.go"), []byte("changed"), 0644)
+
+	mc := &MoldConfig{
+		gitVersion: tr.versionWithConfig(VersionConfig{}),
+		BranchTag:  "master",
+		Artifacts:  Artifacts{Publish: []string{"master"}, Images: []ImageConfig{{Name: "app"}}},
+	}
+	sw := &stubWorker{}
+	lc := NewLifeCycle(sw)
+	lc.log = ioutil.Discard
+	if err := lc.Run(mc); err == nil {
+		t.Fatal("should refuse to publish a dirty tree")
+	}
+	if strings.Join(sw.phases, ",") != "setup,build,artifacts,teardown" {
+		t.Fatal("should not publish:", sw.phases)
+	}
+
+	mc.Artifacts.AllowDirty = true
+	sw.phases = nil
+	if err := lc.Run(mc); err != nil {
+		t.Fatal(err)
+	}
+	if sw.phases[3] != "publish" {
+		t.Fatal("should publish:", sw.phases)
+	}
+}
@@ -13,14 +13,26 @@ import (
 
 var (
 	dockerURI   = flag.String("uri", "", "Docker URI")
+	tlsVerify   = flag.Bool("tlsverify", false, "Use TLS and verify the daemon")
+	tlsCACert   = flag.String("tlscacert", "", "Trust certs signed only by this CA")
+	tlsCert     = flag.String("tlscert", "", "Path to TLS certificate file")
+	tlsKey      = flag.String("tlskey", "", "Path to TLS key file")
 	buildFile   = flag.String("f", defaultBuildConfigName, "Build config file")
-	buildTarget = flag.String("t", "", "Build target [build|artifacts|publish]")
+	buildTarget = flag.String("t", "", "Build target [build|artifacts|publish|cache|release|export|promote] optionally as <target>/<arg>")
 
 	showVersion = flag.Bool("version", false, "Show version")
 	variable    = flag.String("var", "", "Show value of vairable specified in the configuration file")
 
 	initMoldCfg    = flag.Bool("init", false, "Initialize a new mold file.")
 	showAppVersion = flag.Bool("app-version", false, "Show the app version per mold")
+
+	allowDirty = flag.Bool("allow-dirty", false, "Allow publishing from a dirty working tree")
+	buildRef   = flag.String("ref", "", "Build a branch, tag or commit from a temporary checkout")
+	offline    = flag.Bool("offline", false, "Never pull images and fail if any are not available locally")
+
+	showChangelog   = flag.Bool("changelog", false, "Show the changelog")
+	changelogRange  = flag.String("changelog-range", "", "Changelog commit range <from>..<to>")
+	changelogFormat = flag.String("changelog-format", changelogMarkdown, "Changelog format [markdown|json]")
 )
 
 func init() {
@@ -29,11 +41,39 @@ func init() {
 	//log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
+// dockerClientConfig returns the docker client config from the environment
+// overridden by any flags supplied
+func dockerClientConfig(uri string) *DockerClientConfig {
+	cfg := NewDockerClientConfigFromEnv()
+	if len(uri) > 0 {
+		cfg.Host = uri
+	}
+	if *tlsVerify {
+		cfg.TLSVerify = true
+	}
+	if len(*tlsCACert) > 0 {
+		cfg.CACert = *tlsCACert
+	}
+	if len(*tlsCert) > 0 {
+		cfg.Cert = *tlsCert
+	}
+	if len(*tlsKey) > 0 {
+		cfg.Key = *tlsKey
+	}
+	return cfg
+}
+
 func initializeBuild(moldFile, uri string) (*MoldConfig, *DockerWorker, error) {
-	moldConfig, err := readMoldConfig(moldFile)
+	return initializeBuildAtRef(moldFile, uri, nil)
+}
+
+// initializeBuildAtRef initializes the build of the ref checked out or of the
+// working tree if nil
+func initializeBuildAtRef(moldFile, uri string, co *refCheckout) (*MoldConfig, *DockerWorker, error) {
+	moldConfig, err := readMoldConfigAtRef(moldFile, co)
 	if err == nil {
 		var dcli *Docker
-		if dcli, err = NewDocker(uri); err == nil {
+		if dcli, err = NewDockerWithConfig(dockerClientConfig(uri)); err == nil {
 			var dw *DockerWorker
 			if dw, err = NewDockerWorker(dcli); err == nil {
 				return moldConfig, dw, nil
@@ -43,6 +83,35 @@ func initializeBuild(moldFile, uri string) (*MoldConfig, *DockerWorker, error) {
 	return nil, nil, err
 }
 
+// projectGitVersion returns the git version using the versioning config of the
+// mold file if there is one.
+func projectGitVersion(moldFile string) (*gitVersion, error) {
+	if mc, err := readMoldConfig(moldFile); err == nil {
+		return mc.gitVersion, nil
+	}
+	return newGitVersion(".")
+}
+
+// printChangelog writes the changelog of the range to stdout.  The range
+// defaults to the latest tag..HEAD
+func printChangelog(rng, format string) error {
+	gt, err := projectGitVersion(*buildFile)
+	if err != nil {
+		return err
+	}
+	from, to := parseChangelogRange(rng)
+	cl, err := gt.Changelog(from, to)
+	if err != nil {
+		return err
+	}
+	b, err := cl.Render(format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(b, '\n'))
+	return err
+}
+
 func getVar(key, moldFile string) (string, error) {
 	moldConfig, err := readMoldConfig(moldFile)
 	if err == nil {
@@ -61,9 +130,15 @@ func main() {
 		printVersion()
 		os.Exit(0)
 	} else if *showAppVersion {
-		gt, _ := newGitVersion(".")
+		gt, _ := projectGitVersion(*buildFile)
 		fmt.Println(gt.Version())
 		os.Exit(0)
+	} else if *showChangelog {
+		if err := printChangelog(*changelogRange, *changelogFormat); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	} else if *initMoldCfg {
 		if err := initializeMoldConfig("."); err != nil {
 			fmt.Println(err)
@@ -82,20 +157,42 @@ func main() {
 		os.Exit(0)
 	}
 
-	moldConfig, worker, err := initializeBuild(*buildFile, *dockerURI)
+	var co *refCheckout
+	if *buildRef != "" {
+		var err error
+		if co, err = checkoutRef(".", *buildRef); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Checked out %s to %s", *buildRef, co.Dir)
+	}
+
+	moldConfig, worker, err := initializeBuildAtRef(*buildFile, *dockerURI, co)
 	if err != nil {
+		co.Cleanup()
 		log.Fatal(err)
 	}
+	if *allowDirty {
+		moldConfig.Artifacts.AllowDirty = true
+	}
+	if *offline {
+		moldConfig.Offline = true
+	}
 
 	lc := NewLifeCycle(worker)
-	// Listen for signals for a clean shutdown
+	// Listen for signals for a clean shutdown.  A second signal forces an exit
+	// without waiting for the teardown.
 	go func() {
-		sigs := make(chan os.Signal, 1)
+		sigs := make(chan os.Signal, 2)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		<-sigs
+		log.Println("Aborting... (repeat to force)")
 		if e := lc.Abort(); e != nil {
 			log.Println("ERR", e)
 		}
+		<-sigs
+		log.Println("Forced exit")
+		co.Cleanup()
+		os.Exit(130)
 	}()
 	// Run targets
 	target, targetArg := parseTarget(*buildTarget)
@@ -110,6 +207,9 @@ func main() {
 		}
 	}
 
+	if e := co.Cleanup(); e != nil {
+		log.Println("ERR", e)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
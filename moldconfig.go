@@ -5,10 +5,10 @@ import (
 	"os"
 	"strings"
 
-	"bytes"
-	"io/ioutil"
 	"path/filepath"
+	"time"
 
+	units "github.com/docker/go-units"
 	"gopkg.in/yaml.v2"
 )
 
@@ -24,9 +24,18 @@ type MoldConfig struct {
 	BranchTag string `yaml:"-"`
 	// LastCommit for the branch
 	LastCommit string `yaml:"-"`
+	// PullRequest number or id when building one on CI
+	PullRequest string `yaml:"-"`
+	// CI system detected from the environment
+	CI string `yaml:"-"`
+	// RunID of the CI build or unique to the run if not on CI
+	RunID string `yaml:"-"`
 	// Context is the root of the build.  This defaults to the current working
 	// directory.
 	Context string `yaml:",omitempty"`
+	// Workspace sets how the context is made available to build containers. Either
+	// bind (default) or volume for remote daemons.
+	Workspace string `yaml:",omitempty"`
 	// Service i.e. containers needed to perform build
 	Services []DockerRunConfig
 	// Builds to perform
@@ -35,10 +44,67 @@ type MoldConfig struct {
 	Artifacts Artifacts
 	// Allow docker daemon access in the container
 	AllowDockerAccess bool `yaml:"docker,omitempty"`
+	// Retention policy for cached build images
+	CacheRetention CacheRetentionConfig `yaml:"cache_retention,omitempty"`
+	// Registry and optional namespace cached build images are pushed to and
+	// pulled from i.e. registry.example.com/ci
+	CacheRegistry string `yaml:"cache_registry,omitempty"`
+	// Retries of registry pulls and pushes failing with a transient error
+	Retry RetryConfig `yaml:",omitempty"`
+	// Default image pull policy of build and service containers
+	Pull string `yaml:",omitempty"`
+	// Offline forces the pull policy to never
+	Offline bool `yaml:"-"`
+	// Strategy to compute the version when not on a tag
+	Versioning VersionConfig `yaml:",omitempty"`
+	// Changelog written into the context before the build
+	Changelog ChangelogConfig `yaml:",omitempty"`
+	// BuildInfo is the path, relative to the context, the build metadata is
+	// written to as json before the build
+	BuildInfo string `yaml:"build_info,omitempty"`
 
 	Variables map[string]string `yaml:",omitempty"`
 	// stores version information from git
 	gitVersion *gitVersion
+	// outputDir is where relative build outputs, exports and the digests file
+	// are written.  This is the context except when building a ref, where the
+	// checkout is removed after the run, and it is the context in the working
+	// tree instead.
+	outputDir string
+}
+
+// CacheRetentionConfig limits the cached build images kept for the repo.  Zero
+// values are unlimited.
+type CacheRetentionConfig struct {
+	Keep    int    `yaml:",omitempty"`         // images to keep per build step
+	MaxAge  string `yaml:"max_age,omitempty"`  // i.e. 168h
+	MaxSize string `yaml:"max_size,omitempty"` // total size i.e. 10GB
+
+	maxAge  time.Duration
+	maxSize int64
+}
+
+// IsSet reports whether any retention limit is configured
+func (crc *CacheRetentionConfig) IsSet() bool {
+	return crc.Keep > 0 || crc.maxAge > 0 || crc.maxSize > 0
+}
+
+func (crc *CacheRetentionConfig) parse() error {
+	var err error
+	if crc.Keep < 0 {
+		return fmt.Errorf("cache_retention: keep must be positive")
+	}
+	if crc.MaxAge != "" {
+		if crc.maxAge, err = time.ParseDuration(crc.MaxAge); err != nil {
+			return fmt.Errorf("cache_retention: max_age: %v", err)
+		}
+	}
+	if crc.MaxSize != "" {
+		if crc.maxSize, err = units.FromHumanSize(crc.MaxSize); err != nil {
+			return fmt.Errorf("cache_retention: max_size: %v", err)
+		}
+	}
+	return nil
 }
 
 // DefaultMoldConfig is a blank mold config used to initialize empty projects
@@ -54,13 +120,55 @@ func DefaultMoldConfig(name string) *MoldConfig {
 
 // NewMoldConfig creates a new config from yaml formatted bytes
 func NewMoldConfig(fileBytes []byte) (*MoldConfig, error) {
+	return newMoldConfigAtRef(fileBytes, nil)
+}
+
+// newMoldConfigAtRef returns the config of the mold file of a ref checked out to
+// build instead of the working tree.  Paths relative to the working directory
+// are resolved within the checkout.
+func newMoldConfigAtRef(fileBytes []byte, co *refCheckout) (*MoldConfig, error) {
 	var mc MoldConfig
 	err := yaml.Unmarshal(fileBytes, &mc)
 	if err != nil {
 		return nil, err
 	}
 
-	mc.gitVersion, _ = newGitVersion(".")
+	if err = mc.Versioning.parse(); err != nil {
+		return nil, err
+	}
+	if err = mc.Changelog.parse(); err != nil {
+		return nil, err
+	}
+	if mc.BuildInfo != "" {
+		if err = validateContextFile("build_info", mc.BuildInfo); err != nil {
+			return nil, err
+		}
+	}
+	if err = mc.Artifacts.Export.parse(); err != nil {
+		return nil, err
+	}
+	if mc.Artifacts.DigestsFile != "" {
+		if err = validateContextFile("digests_file", mc.Artifacts.DigestsFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range mc.Artifacts.Insecure {
+		if r == "" || strings.ContainsAny(r, "/ ") {
+			return nil, fmt.Errorf("insecure_registries: invalid registry, i.e. localhost:5000: %q", r)
+		}
+	}
+	if co != nil {
+		if mc.gitVersion, err = newGitVersionAtRef(".", mc.Versioning, co.Ref); err != nil {
+			return nil, err
+		}
+		if mc.outputDir, err = filepath.Abs(mc.Context); err != nil {
+			return nil, err
+		}
+		mc.Context = co.path(mc.Context)
+		mc.checkoutPaths(co)
+	} else {
+		mc.gitVersion, _ = newGitVersionWithConfig(".", mc.Versioning)
+	}
 
 	// Set current working directory if not specified
 	if mc.Context == "" || mc.Context == "." || mc.Context == "./" {
@@ -69,6 +177,35 @@ func NewMoldConfig(fileBytes []byte) (*MoldConfig, error) {
 		}
 	}
 
+	if mc.outputDir == "" {
+		mc.outputDir = mc.Context
+	}
+
+	switch mc.Workspace {
+	case "":
+		mc.Workspace = workspaceBind
+	case workspaceBind, workspaceVolume:
+	default:
+		return nil, fmt.Errorf("invalid workspace: %s", mc.Workspace)
+	}
+
+	if err = mc.CacheRetention.parse(); err != nil {
+		return nil, err
+	}
+	if err = mc.Retry.parse(); err != nil {
+		return nil, err
+	}
+	if err = validatePullPolicy(mc.Pull); err != nil {
+		return nil, err
+	}
+	for _, rcs := range [][]DockerRunConfig{mc.Services, mc.Build} {
+		for _, rc := range rcs {
+			if err = validatePullPolicy(rc.Pull); err != nil {
+				return nil, fmt.Errorf("%s: %v", rc.Image, err)
+			}
+		}
+	}
+
 	for i, v := range mc.Build {
 		if v.Shell == "" {
 			mc.Build[i].Shell = "/bin/sh"
@@ -93,6 +230,18 @@ func NewMoldConfig(fileBytes []byte) (*MoldConfig, error) {
 
 	mc.checkRepoInfo()
 	mc.readEnvVars()
+	if mc.RunID == "" {
+		mc.RunID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	if co != nil {
+		// the ref being built rather than that of the CI environment
+		ri := mc.gitVersion.repoInfo()
+		if mc.BranchTag = ri.BranchTag(); mc.BranchTag == "" {
+			mc.BranchTag = repoInfo{Branch: co.Ref}.BranchTag()
+		}
+		mc.LastCommit = shortCommit(ri.Commit)
+		mc.PullRequest = ""
+	}
 
 	// try to set the name based on the repo url.
 	if mc.RepoURL != "" {
@@ -102,6 +251,11 @@ func NewMoldConfig(fileBytes []byte) (*MoldConfig, error) {
 			}
 		}
 	}
+	// the local remote is informational only so the name remains that of the
+	// project directory i.e. distinct per project of a monorepo
+	if mc.RepoURL == "" {
+		mc.RepoURL = mc.gitVersion.repoInfo().URL
+	}
 
 	return &mc, err
 }
@@ -111,6 +265,9 @@ func (mc *MoldConfig) normalizeArtifactsPubs() {
 	for i := range mc.Artifacts.Publish {
 		mc.Artifacts.Publish[i] = strings.Replace(mc.Artifacts.Publish[i], "${APP_VERSION}", mc.gitVersion.Version(), -1)
 	}
+	for i := range mc.Artifacts.Images {
+		mc.Artifacts.Images[i].ReplacePublishVars("${APP_VERSION}", mc.gitVersion.Version())
+	}
 }
 
 // Normalize image tag vars.
@@ -120,9 +277,24 @@ func (mc *MoldConfig) normalizeArtifactsImageTags() {
 		mc.Artifacts.Images[i].ReplaceTagVars("${APP_VERSION_SHORT}", mc.gitVersion.TagVersion())
 		mc.Artifacts.Images[i].ReplaceTagVars("${APP_COMMIT}", mc.gitVersion.Commit())
 		mc.Artifacts.Images[i].ReplaceTagVars("${APP_COMMIT_INDEX}", fmt.Sprintf("%d", mc.gitVersion.distance))
+		mc.Artifacts.Images[i].ReplaceTagVars("${APP_NEXT_VERSION}", mc.gitVersion.NextVersion())
 	}
 }
 
+// pullPolicy returns the image pull policy of the build or service container.
+// Offline always never pulls.
+func (mc *MoldConfig) pullPolicy(rc DockerRunConfig) string {
+	switch {
+	case mc.Offline:
+		return pullNever
+	case rc.Pull != "":
+		return rc.Pull
+	case mc.Pull != "":
+		return mc.Pull
+	}
+	return pullIfNotPresent
+}
+
 // Name returns the name of the build image to create
 func (mc *MoldConfig) Name() string {
 	if len(mc.LastCommit) > 7 {
@@ -140,6 +312,8 @@ func (mc *MoldConfig) setBuildEnvVars() {
 		"APP_VERSION_SHORT=" + mc.gitVersion.TagVersion(),
 		"APP_COMMIT=" + mc.gitVersion.Commit(),
 		fmt.Sprintf("APP_COMMIT_INDEX=%d", mc.gitVersion.distance),
+		"APP_NEXT_VERSION=" + mc.gitVersion.NextVersion(),
+		fmt.Sprintf("APP_DIRTY=%t", mc.gitVersion.Dirty()),
 	}
 
 	for i, v := range mc.Build {
@@ -151,10 +325,39 @@ func (mc *MoldConfig) setBuildEnvVars() {
 	}
 }
 
-// check and set repo info and naming structure - RE-VISIT
+// outputPath returns the path build results are written to.  Relative paths
+// are relative to the output directory.
+func (mc *MoldConfig) outputPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	if mc.outputDir == "" {
+		return filepath.Join(mc.Context, p)
+	}
+	return filepath.Join(mc.outputDir, p)
+}
+
+// checkoutPaths resolves the image contexts and env files relative to the
+// working directory within the checkout.  The build context is set separately.
+func (mc *MoldConfig) checkoutPaths(co *refCheckout) {
+	for i, img := range mc.Artifacts.Images {
+		if img.Context != "" {
+			mc.Artifacts.Images[i].Context = co.path(img.Context)
+		}
+	}
+	for _, rcs := range [][]DockerRunConfig{mc.Services, mc.Build} {
+		for i := range rcs {
+			for j, ef := range rcs[i].EnvFiles {
+				rcs[i].EnvFiles[j] = co.path(ef)
+			}
+		}
+	}
+}
+
+// check and set repo info and naming structure from the local repository
 func (mc *MoldConfig) checkRepoInfo() {
-	name, bt, lc := mc.computeRepoInfo(mc.Context)
-	mc.setRepoInfoToComputedValuesIfEmpty(name, bt, lc)
+	ri := mc.gitVersion.repoInfo()
+	mc.setRepoInfoToComputedValuesIfEmpty(filepath.Base(mc.Context), ri.BranchTag(), shortCommit(ri.Commit))
 }
 
 func (mc *MoldConfig) setRepoInfoToComputedValuesIfEmpty(name string, branchTag string, lastCommit string) {
@@ -169,50 +372,44 @@ func (mc *MoldConfig) setRepoInfoToComputedValuesIfEmpty(name string, branchTag
 	}
 }
 
-// parse git info from .git/HEAD to get name, branch and commit info.  If not found
-// that item will be an empty string
-func (mc *MoldConfig) computeRepoInfo(path string) (name, branchTag, lastCommit string) {
-	name = filepath.Base(path)
+// shortCommit returns the first 8 characters of the commit or empty if it is
+// not long enough
+func shortCommit(cmt string) string {
+	if len(cmt) > 7 {
+		return cmt[:8]
+	}
+	return ""
+}
 
-	b, err := ioutil.ReadFile(filepath.Join(path, ".git/HEAD"))
-	if err != nil {
+// read repo info from the environment of the CI system if any.  These take
+// precedence over all configs overriding anything prior.
+func (mc *MoldConfig) readEnvVars() {
+	ci := detectCI()
+	if ci == nil {
 		return
 	}
-	lp := strings.Split(string(bytes.TrimSuffix(b, []byte("\n"))), " ")
-
-	switch len(lp) {
-	case 2:
-		pp := strings.Split(lp[1], "/")
-		branchTag = pp[len(pp)-1]
-		if cmt, err := ioutil.ReadFile(filepath.Join(path, ".git", lp[1])); err == nil {
-			if len(cmt) > 7 {
-				lastCommit = string(cmt[:8])
-			}
-		}
-
-	case 1:
-		if len(lp[0]) > 7 {
-			lastCommit = lp[0][:8]
-		}
-		branchTag = mc.gitVersion.getTag(lp[0])
+	ri := ci.Info()
+	mc.CI = ci.Name()
+	mc.RunID = ri.RunID
+	if cmt := shortCommit(ri.Commit); cmt != "" {
+		mc.LastCommit = cmt
 	}
-
-	return name, branchTag, lastCommit
+	if ri.URL != "" {
+		mc.RepoURL = ri.URL
+	}
+	if bt := ri.BranchTag(); bt != "" {
+		mc.BranchTag = bt
+	}
+	mc.PullRequest = ri.PullRequest
 }
 
-// read env vars and config.  These take precedence over all configs overriding
-// anything prior - RE-VISIT
-func (mc *MoldConfig) readEnvVars() {
-	if cmt := os.Getenv("GIT_COMMIT"); len(cmt) > 7 {
-		mc.LastCommit = cmt[:8]
+// ciSummary describes the CI system and pull request being built if any
+func (mc *MoldConfig) ciSummary() string {
+	if mc.CI == "" {
+		return "-"
 	}
-	if rurl := os.Getenv("GIT_URL"); len(rurl) > 0 {
-		mc.RepoURL = rurl
-	}
-	if branchTag := os.Getenv("GIT_BRANCH"); len(branchTag) > 0 {
-		pp := strings.Split(branchTag, "/")
-		if len(pp) > 0 {
-			mc.BranchTag = pp[len(pp)-1]
-		}
+	if mc.PullRequest != "" {
+		return fmt.Sprintf("%s (pull request %s)", mc.CI, mc.PullRequest)
 	}
+	return mc.CI
 }
@@ -143,3 +143,62 @@ func Test_NewMoldConfig_ImageWithoutName(t *testing.T) {
 		t.Errorf("Expected '%s' error message, but got '%s'", expected, err)
 	}
 }
+
+func Test_CacheRetentionConfig_parse(t *testing.T) {
+	crc := CacheRetentionConfig{Keep: 2, MaxAge: "168h", MaxSize: "1GB"}
+	if err := crc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if crc.maxAge.Hours() != 168 || crc.maxSize != 1000000000 || !crc.IsSet() {
+		t.Fatal("wrong values", crc.maxAge, crc.maxSize)
+	}
+
+	if (&CacheRetentionConfig{}).IsSet() {
+		t.Fatal("should not be set")
+	}
+	if err := (&CacheRetentionConfig{MaxAge: "1week"}).parse(); err == nil {
+		t.Fatal("should fail")
+	}
+	if err := (&CacheRetentionConfig{MaxSize: "big"}).parse(); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func Test_MoldConfig_pullPolicy(t *testing.T) {
+	b := []byte(`
+pull: always
+services:
+    - image: redis
+      pull: never
+build:
+    - image: golang:1.8
+      commands: [make]
+`)
+	mc, err := NewMoldConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := mc.pullPolicy(mc.Services[0]); p != pullNever {
+		t.Fatal("should use the container policy", p)
+	}
+	if p := mc.pullPolicy(mc.Build[0]); p != pullAlways {
+		t.Fatal("should default to the config policy", p)
+	}
+	mc.Pull = ""
+	if p := mc.pullPolicy(mc.Build[0]); p != pullIfNotPresent {
+		t.Fatal("should default to if-not-present", p)
+	}
+	mc.Offline = true
+	if p := mc.pullPolicy(mc.Build[0]); p != pullNever {
+		t.Fatal("offline should never pull", p)
+	}
+
+	for _, b := range []string{
+		"pull: sometimes\nbuild:\n    - image: golang\n",
+		"build:\n    - image: golang\n      pull: sometimes\n",
+	} {
+		if _, err = NewMoldConfig([]byte(b)); err == nil || !strings.Contains(err.Error(), "invalid pull policy") {
+			t.Errorf("should fail: %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Promote pushes a published version of the images to their promote registries
+// without rebuilding.  The version is pulled from the first registry of each
+// image unless available locally.  The digest of each pushed reference must be
+// that of the source.
+func (dw *DockerWorker) Promote(ctx context.Context, version string) error {
+	if version == "" {
+		return fmt.Errorf("version required i.e. promote/1.2.3")
+	}
+	if dw.buildConfig == nil || !dw.hasAuth() && len(dw.buildConfig.Artifacts.Insecure) == 0 {
+		return fmt.Errorf("registry auth not specified")
+	}
+
+	var (
+		images     []*ImageConfig
+		registries []string
+	)
+	for i := range dw.buildConfig.Artifacts.Images {
+		ic := &dw.buildConfig.Artifacts.Images[i]
+		if len(ic.Promote) == 0 {
+			continue
+		}
+		images = append(images, ic)
+		reg, _ := ic.PromoteSource(version)
+		registries = append(registries, reg)
+		for _, rc := range ic.PromoteTargets(version) {
+			registries = append(registries, rc.Registry)
+		}
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images to promote")
+	}
+	if err := dw.checkRegistryAuth(registries...); err != nil {
+		return err
+	}
+
+	for _, ic := range images {
+		if ctx.Err() != nil {
+			return errAborted
+		}
+		if err := dw.promoteImage(ctx, ic, version); err != nil {
+			return err
+		}
+	}
+	dw.printPublishSummary()
+
+	return dw.writeDigests()
+}
+
+func (dw *DockerWorker) promoteImage(ctx context.Context, ic *ImageConfig, version string) error {
+	reg, src := ic.PromoteSource(version)
+	prefix := fmt.Sprintf("[promote/%s]", ic.Name)
+
+	if !dw.docker.ImageAvailableLocally(ctx, src) {
+		if err := dw.docker.PullImage(ctx, src, dw.getRegistryAuth(reg), dw.log, prefix); err != nil {
+			return fmt.Errorf("promote %s: %v", src, err)
+		}
+	}
+	rds, err := dw.docker.ImageRepoDigests(ctx, src)
+	if err != nil {
+		return err
+	}
+	// only known if the source was pulled or pushed from here
+	digest := repoDigest(rds, src)
+	if digest == "" {
+		dw.log.Write([]byte(fmt.Sprintf("%s Source digest of %s unknown.  Only checking the pushes are the same\n", prefix, src)))
+	}
+
+	for _, rc := range ic.PromoteTargets(version) {
+		for _, ref := range rc.Paths(ic.Name) {
+			if ctx.Err() != nil {
+				return errAborted
+			}
+			if err = dw.docker.TagImage(ctx, src, ref); err != nil {
+				return err
+			}
+			pushed, err := dw.docker.PushImageDigest(ctx, ref, dw.getRegistryAuth(rc.Registry), os.Stdout, prefix)
+			if err != nil {
+				return err
+			}
+			if digest == "" {
+				digest = pushed
+			} else if pushed != "" && pushed != digest {
+				return fmt.Errorf("promote %s: digest changed from %s to %s", ref, digest, pushed)
+			}
+
+			dw.published = append(dw.published, publishedImage{Ref: ref, Digest: pushed})
+			dw.log.Write([]byte(fmt.Sprintf("%s Promoted %s to %s\n", prefix, src, ref)))
+		}
+	}
+	return nil
+}
+
+// repoDigest returns the digest, i.e. sha256:..., of the repository of the
+// reference from the repo digests of an image.  It is empty if not found.
+func repoDigest(repoDigests []string, ref string) string {
+	repo := imageRepository(ref)
+	for _, rd := range repoDigests {
+		if imageRepository(rd) == repo {
+			return rd[len(repo)+1:]
+		}
+	}
+	return ""
+}
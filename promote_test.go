@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func Test_ImageConfig_Promote(t *testing.T) {
+	ic := ImageConfig{
+		Name:     "d3sw/app",
+		Registry: "staging:5000",
+		Promote: []RegistryConfig{
+			{Registry: "prod:5000"},
+			{Registry: "prod:5000", Tags: []string{"v${APP_VERSION}", "stable"}},
+		},
+	}
+	if err := ic.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// not replaced with the version being built
+	ic.ReplaceTagVars("${APP_VERSION}", "2.0.0-5-abcdef0")
+
+	if reg, src := ic.PromoteSource("1.2.3"); reg != "staging:5000" || src != "staging:5000/d3sw/app:1.2.3" {
+		t.Fatal("wrong source", reg, src)
+	}
+	var paths []string
+	for _, rc := range ic.PromoteTargets("1.2.3") {
+		paths = append(paths, rc.Paths(ic.Name)...)
+	}
+	if p := strings.Join(paths, ","); p != "prod:5000/d3sw/app:1.2.3,prod:5000/d3sw/app:v1.2.3,prod:5000/d3sw/app:stable" {
+		t.Fatal("wrong targets", p)
+	}
+}
+
+func Test_repoDigest(t *testing.T) {
+	rds := []string{"other/app@sha256:abc", "staging:5000/d3sw/app@sha256:def"}
+	if d := repoDigest(rds, "staging:5000/d3sw/app:1.2.3"); d != "sha256:def" {
+		t.Fatal("wrong digest", d)
+	}
+	if d := repoDigest(rds, "prod/d3sw/app:1.2.3"); d != "" {
+		t.Fatal("should not be found", d)
+	}
+}
+
+func Test_Worker_Promote_fail(t *testing.T) {
+	dw := DockerWorker{buildConfig: &MoldConfig{}}
+	if err := dw.Promote(context.Background(), ""); err == nil {
+		t.Fatal("should fail without a version")
+	}
+	if err := dw.Promote(context.Background(), "1.2.3"); err == nil || err.Error() != "registry auth not specified" {
+		t.Fatal("should fail without auth", err)
+	}
+	dw.authCfg = &DockerAuthConfig{Auths: map[string]types.AuthConfig{"docker": {}}}
+	if err := dw.Promote(context.Background(), "1.2.3"); err == nil || err.Error() != "no images to promote" {
+		t.Fatal("should fail without images", err)
+	}
+}
+
+func Test_Worker_Promote_insecure(t *testing.T) {
+	dw := DockerWorker{buildConfig: &MoldConfig{Artifacts: Artifacts{
+		Insecure: []string{"staging:5000"},
+		Images:   []ImageConfig{{Name: "app", Registry: "staging:5000", Promote: []RegistryConfig{{Registry: "prod:5000"}}}},
+	}}}
+	// the promote registry is not insecure
+	if err := dw.Promote(context.Background(), "1.2.3"); err == nil || err.Error() != "registry auth not specified" {
+		t.Fatal("should fail without auth", err)
+	}
+	dw.buildConfig.Artifacts.Insecure = append(dw.buildConfig.Artifacts.Insecure, "prod:5000")
+	if err := dw.checkRegistryAuth("staging:5000", "prod:5000"); err != nil {
+		t.Fatal("should not need auth", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// refCheckout is a ref of the repo written to a temporary directory so it can
+// be built without touching the working tree.
+type refCheckout struct {
+	Ref string
+	// Dir is the checkout of the repo root
+	Dir string
+	// WorkDir is the working directory within the checkout
+	WorkDir string
+
+	root string // of the repo checked out
+	tmp  string
+}
+
+// checkoutRef writes the files of the ref, i.e. a branch, tag or commit, of the
+// repo containing dir to a temporary directory.  The checkout is named after the
+// repo root so the project name is the same as when building in place.
+// Submodules are not checked out.
+func checkoutRef(dir, ref string) (*refCheckout, error) {
+	gt, err := newGitVersionAtRef(dir, VersionConfig{}, ref)
+	if err != nil {
+		return nil, err
+	}
+	root, err := findRepoRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return nil, err
+	}
+	c, err := gt.r.CommitObject(gt.head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempDir("", "mold-ref")
+	if err != nil {
+		return nil, err
+	}
+	co := &refCheckout{
+		Ref:  ref,
+		Dir:  filepath.Join(tmp, filepath.Base(root)),
+		root: root,
+		tmp:  tmp,
+	}
+	co.WorkDir = filepath.Join(co.Dir, rel)
+
+	if err = writeCommitFiles(c, co.Dir); err != nil {
+		co.Cleanup()
+		return nil, fmt.Errorf("checkout %s: %v", ref, err)
+	}
+	// the working directory is missing if it has no tracked files at the ref
+	if err = os.MkdirAll(co.WorkDir, 0755); err != nil {
+		co.Cleanup()
+		return nil, err
+	}
+	return co, nil
+}
+
+// writeCommitFiles writes the files of the commit tree to dir
+func writeCommitFiles(c *object.Commit, dir string) error {
+	files, err := c.Files()
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	return files.ForEach(func(f *object.File) error {
+		dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if f.Mode == filemode.Symlink {
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dst)
+		}
+
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		rd, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		fh, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(fh, rd); err != nil {
+			fh.Close()
+			return err
+		}
+		return fh.Close()
+	})
+}
+
+// path returns the path within the checkout of a path relative to the working
+// directory.  Absolute paths outside of the repo are returned as is.
+func (co *refCheckout) path(p string) string {
+	if !filepath.IsAbs(p) {
+		return filepath.Join(co.WorkDir, p)
+	}
+	rel, err := filepath.Rel(co.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return filepath.Join(co.Dir, rel)
+}
+
+// Cleanup removes the checkout
+func (co *refCheckout) Cleanup() error {
+	if co == nil {
+		return nil
+	}
+	return os.RemoveAll(co.tmp)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_checkoutRef(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	tr.commitFile("api/main.go", "api")
+	v1 := tr.commitFile("web/index.html", "web")
+	tr.tag("v1.0.0", v1)
+	tr.commitFile("web/index.html", "feat: new web")
+	ioutil.WriteFile(filepath.Join(tr.dir, "web", "index.html"), []byte("changed"), 0644)
+
+	co, err := checkoutRef(filepath.Join(tr.dir, "web"), "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Cleanup()
+
+	if filepath.Base(co.Dir) != filepath.Base(tr.dir) {
+		t.Fatal("should be named after the repo:", co.Dir)
+	}
+	if co.WorkDir != filepath.Join(co.Dir, "web") {
+		t.Fatal("wrong working dir:", co.WorkDir)
+	}
+	b, err := ioutil.ReadFile(co.path("index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "web 2" {
+		t.Fatal("should be the file of the tag:", string(b))
+	}
+	if _, err = os.Stat(filepath.Join(co.Dir, "api", "main.go")); err != nil {
+		t.Fatal(err)
+	}
+	if p := co.path(filepath.Join(tr.dir, "api")); p != filepath.Join(co.Dir, "api") {
+		t.Fatal("should map paths within the repo:", p)
+	}
+	if p := co.path("/outside"); p != "/outside" {
+		t.Fatal("should not map paths outside of the repo:", p)
+	}
+
+	if err = co.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(co.Dir); !os.IsNotExist(err) {
+		t.Fatal("should be removed")
+	}
+
+	if _, err = checkoutRef(tr.dir, "unknown"); err == nil {
+		t.Fatal("should fail on an unknown ref")
+	}
+}
+
+func Test_gitVersion_atRef(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	v1 := tr.commit("initial")
+	tr.tag("v1.0.0", v1)
+	fix := tr.commit("fix: bug")
+	tr.commit("feat: new")
+	ioutil.WriteFile(filepath.Join(tr.dir, "file1"), []byte("changed"), 0644)
+
+	gt, err := newGitVersionAtRef(tr.dir, VersionConfig{}, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gt.Version() != "1.0.0" || gt.Dirty() {
+		t.Fatal("should be the clean tag:", gt.Version())
+	}
+	if ri := gt.repoInfo(); ri.BranchTag() != "v1.0.0" {
+		t.Fatal("should be the tag:", ri)
+	}
+
+	// short hash
+	if gt, err = newGitVersionAtRef(tr.dir, VersionConfig{}, fix.String()[:7]); err != nil {
+		t.Fatal(err)
+	}
+	if gt.Commit() != fix.String()[:7] || gt.NextVersion() != "1.0.1" {
+		t.Fatal("should be the fix:", gt.Commit(), gt.NextVersion())
+	}
+
+	if gt, err = newGitVersionAtRef(tr.dir, VersionConfig{}, "master"); err != nil {
+		t.Fatal(err)
+	}
+	if gt.repoInfo().Branch != "master" || gt.NextVersion() != "1.1.0" {
+		t.Fatal("should be the branch:", gt.repoInfo(), gt.NextVersion())
+	}
+}
+
+func Test_newMoldConfigAtRef_outputs(t *testing.T) {
+	tr := newTestRepo(t)
+	defer tr.cleanup()
+	v1 := tr.commitFile("web/index.html", "web")
+	tr.tag("v1.0.0", v1)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(tr.dir); err != nil {
+		t.Fatal(err)
+	}
+	co, err := checkoutRef(".", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Cleanup()
+
+	mc, err := newMoldConfigAtRef([]byte("context: web\nbuild:\n  - image: alpine\n"), co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := filepath.EvalSymlinks(tr.dir)
+	if mc.Context != filepath.Join(co.Dir, "web") {
+		t.Fatal("should build the checkout:", mc.Context)
+	}
+	if p, _ := filepath.EvalSymlinks(filepath.Dir(mc.outputPath("dist"))); p != filepath.Join(root, "web") {
+		t.Fatal("should write outputs to the working tree:", mc.outputPath("dist"))
+	}
+	if p := mc.outputPath("/abs/dist"); p != "/abs/dist" {
+		t.Fatal("should keep absolute paths:", p)
+	}
+}
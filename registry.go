@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// time allowed for an insecure registry, i.e. one started as a service, to
+// become available before publishing
+const defaultRegistryTimeout = 30 * time.Second
+
+// interval between checks of an insecure registry
+const registryPingInterval = time.Second
+
+// pingRegistry checks the registry serves the v2 api over plain http.  An
+// unauthorized response means it is up.
+func pingRegistry(ctx context.Context, registry string) error {
+	req, err := http.NewRequest("GET", "http://"+registry+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	cli := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusUnauthorized:
+		return nil
+	}
+	return fmt.Errorf("unexpected status: %s", rsp.Status)
+}
+
+// waitRegistry waits for the registry to respond or the timeout
+func waitRegistry(ctx context.Context, registry string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := pingRegistry(ctx, registry)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(registryPingInterval):
+		}
+	}
+}
+
+// checkRegistryAuth returns an error unless registry auth is configured or all
+// the registries are insecure, which are pushed to without auth
+func (dw *DockerWorker) checkRegistryAuth(registries ...string) error {
+	if dw.hasAuth() {
+		return nil
+	}
+	for _, reg := range registries {
+		if !dw.buildConfig.Artifacts.IsInsecure(reg) {
+			return fmt.Errorf("registry auth not specified")
+		}
+	}
+	return nil
+}
+
+// checkInsecureRegistries waits for the insecure registries of the refs to be
+// available.  As the push is performed by the daemon a registry not reachable
+// from here, i.e. the daemon is remote, is only logged as is one the daemon
+// does not allow plain http to.
+func (dw *DockerWorker) checkInsecureRegistries(ctx context.Context, refs []publishRef) error {
+	checked := map[string]bool{}
+	for _, ref := range refs {
+		reg := ref.Registry
+		if checked[reg] || !dw.buildConfig.Artifacts.IsInsecure(reg) {
+			continue
+		}
+		checked[reg] = true
+
+		prefix := fmt.Sprintf("[publish/%s]", reg)
+		if err := waitRegistry(ctx, reg, defaultRegistryTimeout); err != nil {
+			if ctx.Err() != nil {
+				return errAborted
+			}
+			dw.log.Write([]byte(fmt.Sprintf("%s Registry not reachable: %v\n", prefix, err)))
+		} else {
+			dw.log.Write([]byte(fmt.Sprintf("%s Registry available over http\n", prefix)))
+		}
+
+		insecure, err := dw.docker.RegistryInsecure(ctx, reg)
+		if err != nil {
+			return err
+		}
+		if !insecure {
+			dw.log.Write([]byte(fmt.Sprintf("%s Registry not in the insecure-registries of the daemon\n", prefix)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+var integration = flag.Bool("integration", false, "Run integration tests publishing to a local registry")
+
+func Test_pingRegistry(t *testing.T) {
+	status := http.StatusUnauthorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	if err := pingRegistry(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusInternalServerError
+	if err := pingRegistry(context.Background(), reg); err == nil {
+		t.Fatal("should fail on a server error")
+	}
+	if err := waitRegistry(context.Background(), reg, 10*time.Millisecond); err == nil {
+		t.Fatal("should time out")
+	}
+}
+
+func Test_Worker_Publish_insecure(t *testing.T) {
+	d := DockerWorker{buildConfig: &MoldConfig{Artifacts: Artifacts{
+		Publish:  []string{"*"},
+		Insecure: []string{"localhost:5000"},
+		Images:   []ImageConfig{{Name: "app", Registry: "registry.example.com"}},
+	}}}
+	// auth is only optional for the insecure registries
+	if err := d.Publish(context.Background()); err == nil || err.Error() != "registry auth not specified" {
+		t.Fatal("should fail without auth", err)
+	}
+}
+
+func Test_Worker_checkRegistryAuth(t *testing.T) {
+	d := DockerWorker{buildConfig: &MoldConfig{Artifacts: Artifacts{
+		Insecure: []string{"localhost:5000", "registry.local"},
+	}}}
+	for _, tc := range []struct {
+		registries []string
+		ok         bool
+	}{
+		{[]string{"localhost:5000"}, true},
+		{[]string{"localhost:5000", "registry.local"}, true},
+		{nil, true},
+		{[]string{"localhost:5000", "registry.example.com"}, false},
+		{[]string{"registry.example.com"}, false},
+		{[]string{""}, false}, // docker hub
+	} {
+		if err := d.checkRegistryAuth(tc.registries...); (err == nil) != tc.ok {
+			t.Errorf("%v: %v", tc.registries, err)
+		}
+	}
+
+	d.authCfg = &DockerAuthConfig{Auths: map[string]types.AuthConfig{"registry.example.com": {}}}
+	if err := d.checkRegistryAuth("localhost:5000", "registry.example.com"); err != nil {
+		t.Fatal("should pass with auth", err)
+	}
+}
+
+// Test_Integration_Publish publishes to a registry:2 service over plain http.
+// Requires docker and is run with -integration i.e. make test-integration
+func Test_Integration_Publish(t *testing.T) {
+	if !*integration {
+		t.Skip("run with -integration")
+	}
+
+	mc, worker, err := initializeBuild("./testdata/mold.registry.yml", *dockerURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.authCfg = nil
+
+	lc := NewLifeCycle(worker)
+	if err = lc.Run(mc); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.RemoveArtifacts(context.Background())
+
+	if len(worker.published) == 0 {
+		t.Fatal("nothing published")
+	}
+	for _, pi := range worker.published {
+		if !strings.HasPrefix(pi.Ref, "localhost:5000/") || pi.Digest == "" {
+			t.Fatalf("not published to the local registry: %+v", pi)
+		}
+	}
+}
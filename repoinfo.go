@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// repoInfo describes the revision being built
+type repoInfo struct {
+	Branch      string
+	Tag         string
+	Commit      string // full hash
+	URL         string
+	PullRequest string
+	RunID       string // of the CI build
+}
+
+// BranchTag returns the branch or if none the tag being built.  Only the last
+// path element is used i.e. feature/x is x
+func (ri repoInfo) BranchTag() string {
+	bt := ri.Branch
+	if bt == "" {
+		bt = ri.Tag
+	}
+	pp := strings.Split(bt, "/")
+	return pp[len(pp)-1]
+}
+
+// ciProvider supplies the repo info from the environment of a CI system.  This
+// is needed as CI systems usually check out a detached HEAD.
+type ciProvider interface {
+	Name() string
+	Detect() bool
+	Info() repoInfo
+}
+
+// ciProviders in the order detected.  Jenkins is last as its GIT_* variables
+// are also set by other tools.
+var ciProviders = []ciProvider{
+	githubActions{},
+	gitlabCI{},
+	travisCI{},
+	droneCI{},
+	jenkinsCI{},
+}
+
+// detectCI returns the provider of the current environment or nil if none
+func detectCI() ciProvider {
+	for _, p := range ciProviders {
+		if p.Detect() {
+			return p
+		}
+	}
+	return nil
+}
+
+// stripURLCredentials removes any user info, e.g. a CI job token, from the url
+func stripURLCredentials(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
+type githubActions struct{}
+
+func (githubActions) Name() string { return "github" }
+func (githubActions) Detect() bool { return os.Getenv("GITHUB_ACTIONS") == "true" }
+func (githubActions) Info() repoInfo {
+	ri := repoInfo{Commit: os.Getenv("GITHUB_SHA"), RunID: os.Getenv("GITHUB_RUN_ID")}
+	if srv, repo := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		if srv == "" {
+			srv = "https://github.com"
+		}
+		ri.URL = srv + "/" + repo
+	}
+
+	ref := os.Getenv("GITHUB_REF")
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		ri.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		ri.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	case strings.HasPrefix(ref, "refs/pull/"):
+		// refs/pull/<number>/merge
+		ri.PullRequest = strings.SplitN(strings.TrimPrefix(ref, "refs/pull/"), "/", 2)[0]
+		ri.Branch = os.Getenv("GITHUB_HEAD_REF")
+	}
+	return ri
+}
+
+type gitlabCI struct{}
+
+func (gitlabCI) Name() string { return "gitlab" }
+func (gitlabCI) Detect() bool { return os.Getenv("GITLAB_CI") != "" }
+func (gitlabCI) Info() repoInfo {
+	ri := repoInfo{
+		Commit:      os.Getenv("CI_COMMIT_SHA"),
+		URL:         os.Getenv("CI_PROJECT_URL"),
+		Tag:         os.Getenv("CI_COMMIT_TAG"),
+		PullRequest: os.Getenv("CI_MERGE_REQUEST_IID"),
+		RunID:       os.Getenv("CI_PIPELINE_ID"),
+	}
+	if ri.URL == "" {
+		ri.URL = stripURLCredentials(os.Getenv("CI_REPOSITORY_URL"))
+	}
+	if ri.Tag == "" {
+		ri.Branch = os.Getenv("CI_COMMIT_REF_NAME")
+	}
+	if b := os.Getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"); b != "" {
+		ri.Branch = b
+	}
+	return ri
+}
+
+type travisCI struct{}
+
+func (travisCI) Name() string { return "travis" }
+func (travisCI) Detect() bool { return os.Getenv("TRAVIS") == "true" }
+func (travisCI) Info() repoInfo {
+	ri := repoInfo{
+		Commit: os.Getenv("TRAVIS_COMMIT"),
+		Tag:    os.Getenv("TRAVIS_TAG"),
+		RunID:  os.Getenv("TRAVIS_BUILD_ID"),
+	}
+	if slug := os.Getenv("TRAVIS_REPO_SLUG"); slug != "" {
+		ri.URL = "https://github.com/" + slug
+	}
+	if ri.Tag == "" {
+		ri.Branch = os.Getenv("TRAVIS_BRANCH")
+	}
+	// TRAVIS_BRANCH is the target branch for pull requests
+	if pr := os.Getenv("TRAVIS_PULL_REQUEST"); pr != "" && pr != "false" {
+		ri.PullRequest = pr
+		ri.Branch = os.Getenv("TRAVIS_PULL_REQUEST_BRANCH")
+	}
+	return ri
+}
+
+type droneCI struct{}
+
+func (droneCI) Name() string { return "drone" }
+func (droneCI) Detect() bool { return os.Getenv("DRONE") == "true" }
+func (droneCI) Info() repoInfo {
+	ri := repoInfo{
+		Commit:      os.Getenv("DRONE_COMMIT_SHA"),
+		URL:         os.Getenv("DRONE_REPO_LINK"),
+		Tag:         os.Getenv("DRONE_TAG"),
+		PullRequest: os.Getenv("DRONE_PULL_REQUEST"),
+		RunID:       os.Getenv("DRONE_BUILD_NUMBER"),
+	}
+	if ri.URL == "" {
+		ri.URL = stripURLCredentials(os.Getenv("DRONE_GIT_HTTP_URL"))
+	}
+	if ri.Tag == "" {
+		ri.Branch = os.Getenv("DRONE_BRANCH")
+	}
+	if b := os.Getenv("DRONE_SOURCE_BRANCH"); ri.PullRequest != "" && b != "" {
+		ri.Branch = b
+	}
+	return ri
+}
+
+// jenkinsCI reads the variables set by the Jenkins git plugin
+type jenkinsCI struct{}
+
+func (jenkinsCI) Name() string { return "jenkins" }
+func (jenkinsCI) Detect() bool {
+	return os.Getenv("JENKINS_URL") != "" || os.Getenv("GIT_COMMIT") != "" ||
+		os.Getenv("GIT_BRANCH") != "" || os.Getenv("GIT_URL") != ""
+}
+func (jenkinsCI) Info() repoInfo {
+	ri := repoInfo{
+		Commit:      os.Getenv("GIT_COMMIT"),
+		URL:         stripURLCredentials(os.Getenv("GIT_URL")),
+		Tag:         os.Getenv("TAG_NAME"),
+		PullRequest: os.Getenv("CHANGE_ID"),
+		RunID:       os.Getenv("BUILD_TAG"), // jenkins-<job>-<number>
+	}
+	if ri.Tag == "" {
+		ri.Branch = strings.TrimPrefix(os.Getenv("GIT_BRANCH"), "origin/")
+		if ri.PullRequest != "" && os.Getenv("CHANGE_BRANCH") != "" {
+			ri.Branch = os.Getenv("CHANGE_BRANCH")
+		}
+	}
+	return ri
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaults for retrying registry pulls and pushes
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// RetryConfig controls retrying registry pulls and pushes failing with a
+// transient error
+type RetryConfig struct {
+	Attempts   int    `yaml:",omitempty"`            // total attempts.  1 disables retries
+	Backoff    string `yaml:",omitempty"`            // delay before the first retry doubled for each after
+	MaxBackoff string `yaml:"max_backoff,omitempty"` // maximum delay between attempts
+
+	policy retryPolicy
+}
+
+func (rc *RetryConfig) parse() error {
+	rc.policy = defaultRetryPolicy()
+	if rc.Attempts < 0 {
+		return fmt.Errorf("retry: attempts must be positive")
+	}
+	if rc.Attempts > 0 {
+		rc.policy.attempts = rc.Attempts
+	}
+
+	var err error
+	if rc.Backoff != "" {
+		if rc.policy.backoff, err = time.ParseDuration(rc.Backoff); err != nil {
+			return fmt.Errorf("retry: backoff: %v", err)
+		}
+	}
+	if rc.MaxBackoff != "" {
+		if rc.policy.maxBackoff, err = time.ParseDuration(rc.MaxBackoff); err != nil {
+			return fmt.Errorf("retry: max_backoff: %v", err)
+		}
+	}
+	if rc.policy.maxBackoff < rc.policy.backoff {
+		return fmt.Errorf("retry: max_backoff less than backoff")
+	}
+	return nil
+}
+
+// retryPolicy retries an operation with exponential backoff
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		attempts:   defaultRetryAttempts,
+		backoff:    defaultRetryBackoff,
+		maxBackoff: defaultRetryMaxBackoff,
+	}
+}
+
+// delay returns the time to wait after the failed attempt, starting at 1
+func (rp retryPolicy) delay(attempt int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < attempt && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return d
+}
+
+// do runs the operation until it succeeds, fails with an error that is not
+// retryable or the attempts are exhausted.  Each failed attempt is logged.
+func (rp retryPolicy) do(ctx context.Context, wr io.Writer, prefix, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !isRetryable(err) {
+			if attempt > 1 {
+				wr.Write([]byte(fmt.Sprintf("%s %s failed (attempt %d/%d): %v\n", prefix, op, attempt, rp.attempts, err)))
+			}
+			return err
+		}
+		if attempt >= rp.attempts {
+			wr.Write([]byte(fmt.Sprintf("%s %s failed (attempt %d/%d): %v.  Giving up\n", prefix, op, attempt, rp.attempts, err)))
+			return err
+		}
+
+		d := rp.delay(attempt)
+		wr.Write([]byte(fmt.Sprintf("%s %s failed (attempt %d/%d): %v.  Retrying in %s\n", prefix, op, attempt, rp.attempts, err, d)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+}
+
+// errors of the registry or daemon never resolved by retrying
+var fatalRegistryErrors = []string{
+	"unauthorized",
+	"denied",
+	"authentication required",
+	"manifest invalid",
+	"manifest unknown",
+	"not found",
+	"does not exist",
+	"invalid reference",
+}
+
+// transient errors of the registry or the network
+var retryableRegistryErrors = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"temporary failure",
+	"tls handshake",
+	"toomanyrequests",
+	"too many requests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"status: 5", // received unexpected HTTP status: 5xx
+}
+
+// isRetryable returns whether the error of a pull or push is transient i.e. a
+// timeout, 5xx or a reset connection.  Unknown errors are not.
+func isRetryable(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range fatalRegistryErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range retryableRegistryErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
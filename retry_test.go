@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RetryConfig(t *testing.T) {
+	var rc RetryConfig
+	if err := rc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.policy != defaultRetryPolicy() {
+		t.Fatalf("should default: %+v", rc.policy)
+	}
+
+	rc = RetryConfig{Attempts: 5, Backoff: "2s", MaxBackoff: "10s"}
+	if err := rc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	for attempt, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 4: 10 * time.Second, 40: 10 * time.Second} {
+		if d := rc.policy.delay(attempt); d != want {
+			t.Errorf("attempt %d: have=%s want=%s", attempt, d, want)
+		}
+	}
+
+	for _, rc := range []RetryConfig{{Attempts: -1}, {Backoff: "1x"}, {MaxBackoff: "1x"}, {Backoff: "1m", MaxBackoff: "1s"}} {
+		if err := rc.parse(); err == nil {
+			t.Errorf("should fail: %+v", rc)
+		}
+	}
+}
+
+func Test_isRetryable(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"net/http: TLS handshake timeout":                          true,
+		"read tcp 10.0.0.1:443: connection reset by peer":          true,
+		"received unexpected HTTP status: 503 Service Unavailable": true,
+		"toomanyrequests: You have reached your pull rate limit":   true,
+		"unexpected EOF":                                     true,
+		"unauthorized: authentication required":              false,
+		"denied: requested access to the resource is denied": false,
+		"manifest invalid: manifest invalid":                 false,
+		"Error: image app not found":                         false,
+		"An image does not exist locally with the tag: rp":   false,
+		"something unexpected":                               false,
+	} {
+		if have := isRetryable(fmt.Errorf(msg)); have != want {
+			t.Errorf("%s: have=%v want=%v", msg, have, want)
+		}
+	}
+	if isRetryable(context.Canceled) {
+		t.Fatal("cancelled should not be retried")
+	}
+}
+
+func Test_retryPolicy_do(t *testing.T) {
+	rp := retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+	var buf bytes.Buffer
+
+	n := 0
+	err := rp.do(context.Background(), &buf, "[p]", "Push app", func() error {
+		if n++; n < 3 {
+			return fmt.Errorf("502 Bad Gateway")
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Fatal("should succeed on the last attempt", n, err)
+	}
+	if strings.Count(buf.String(), "Retrying in") != 2 {
+		t.Fatal(buf.String())
+	}
+
+	n = 0
+	err = rp.do(context.Background(), &buf, "[p]", "Push app", func() error {
+		n++
+		return fmt.Errorf("i/o timeout")
+	})
+	if err == nil || n != 3 || !strings.Contains(buf.String(), "Giving up") {
+		t.Fatal("should give up after all attempts", n, err)
+	}
+
+	n = 0
+	err = rp.do(context.Background(), &buf, "[p]", "Push app", func() error {
+		n++
+		return fmt.Errorf("unauthorized: authentication required")
+	})
+	if err == nil || n != 1 {
+		t.Fatal("should not retry a fatal error", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n = 0
+	rp.do(ctx, &buf, "[p]", "Push app", func() error {
+		n++
+		return fmt.Errorf("i/o timeout")
+	})
+	if n != 1 {
+		t.Fatal("should not retry once cancelled")
+	}
+}
+
+func Test_Docker_PullImage_retry(t *testing.T) {
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/create") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch n++; n {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"message":"received unexpected HTTP status: 503 Service Unavailable"}`)
+		case 2:
+			fmt.Fprintln(w, `{"status":"Pulling fs layer","id":"aaa"}`)
+			fmt.Fprintln(w, `{"errorDetail":{"message":"read: connection reset by peer"},"error":"read: connection reset by peer"}`)
+		default:
+			fmt.Fprintln(w, `not json`)
+			fmt.Fprintln(w, `{"status":"Download complete","progressDetail":{"current":10,"total":10},"id":"aaa"}`)
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewDockerWithConfig(&DockerClientConfig{Host: "tcp://" + strings.TrimPrefix(srv.URL, "http://"), APIVersion: "1.25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.retry = retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	var buf bytes.Buffer
+	if err = d.PullImage(context.Background(), "app", nil, &buf, "[p]"); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if n != 3 || strings.Count(buf.String(), "Retrying in") != 2 {
+		t.Fatal(n, buf.String())
+	}
+}
@@ -11,18 +11,54 @@ import (
 
 // DockerRunConfig holds the config to run a container
 type DockerRunConfig struct {
-	Image       string   // Docker image to use for code build
-	Commands    []string // Commands to run in the container
-	Workdir     string   // Working directory in the container
-	Environment []string `yaml:",omitempty"`
-	Volumes     []string `yaml:"volumes,omitempty"`
-	Save        bool     `yaml:",omitempty"` // do not remove container after completion
-	Shell       string   `yaml:",omitempty"`
-	Ports       []string `yaml:",omitempty"` // a quoted list of port mappings
-	Cache       bool     `yaml:",omitempty"`
-	Name        string   `yaml:",omitempty"`
-	CleanUp     bool     `yaml:",omitempty"`
-	EnvFiles    []string `yaml:"env_file,omitempty"` // files with environment variables
+	Image       string              // Docker image to use for code build
+	Commands    []string            // Commands to run in the container
+	Workdir     string              // Working directory in the container
+	Environment []string            `yaml:",omitempty"`
+	Volumes     []string            `yaml:"volumes,omitempty"`
+	Save        bool                `yaml:",omitempty"` // do not remove container after completion
+	Shell       string              `yaml:",omitempty"`
+	Ports       []string            `yaml:",omitempty"` // a quoted list of port mappings
+	Cache       bool                `yaml:",omitempty"`
+	CacheKey    *CacheKeyConfig     `yaml:"cache_key,omitempty"` // inputs the cache image tag is computed from
+	Name        string              `yaml:",omitempty"`
+	CleanUp     bool                `yaml:",omitempty"`
+	EnvFiles    []string            `yaml:"env_file,omitempty"` // files with environment variables
+	Outputs     []string            `yaml:",omitempty"`         // container paths to copy to the host i.e. /src/bin/*:dist/
+	Caches      []CacheVolumeConfig `yaml:",omitempty"`         // persistent dependency directories
+	Pull        string              `yaml:",omitempty"`         // image pull policy.  Defaults to that of the config
+}
+
+// Image pull policies of build and service containers
+const (
+	pullAlways       = "always"         // pull on every run to pick up moved tags
+	pullIfNotPresent = "if-not-present" // pull only if not available locally
+	pullNever        = "never"          // fail if not available locally
+)
+
+// validatePullPolicy returns an error if the policy is not known.  Blank is
+// valid and means the default.
+func validatePullPolicy(policy string) error {
+	switch policy {
+	case "", pullAlways, pullIfNotPresent, pullNever:
+		return nil
+	}
+	return fmt.Errorf("invalid pull policy: %s", policy)
+}
+
+// CacheKeyConfig holds the inputs whose contents key the cached build image in
+// addition to the image, commands and static environment of the step.
+type CacheKeyConfig struct {
+	Files  []string `yaml:",omitempty"` // files or globs relative to the context
+	Values []string `yaml:",omitempty"` // explicit strings i.e. a manual version
+	Env    []string `yaml:",omitempty"` // names of env. vars whose values are included
+}
+
+// CacheVolumeConfig is a directory in the build container persisted in a named
+// volume across runs.
+type CacheVolumeConfig struct {
+	Path string // absolute path in the container i.e. /go/pkg/mod
+	Key  string `yaml:",omitempty"` // file relative to the context whose contents key the volume i.e. go.sum
 }
 
 // BuildCmds returns the command string that is passed in to bash -cex on the
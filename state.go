@@ -22,11 +22,16 @@ type containerState struct {
 	done   bool          // container execution completed
 	save   bool          // keep the container after run completes
 	cache  *cache
+
+	outputs []buildOutput  // paths copied to the host on success
+	caches  []*cacheVolume // persistent volumes mounted in the container
 }
 
 type cache struct {
 	Name string
 	Tag  string
+	Hit  bool   // the cached image was used to run the build
+	Step string // build step producing the image
 }
 
 func (ic *cache) IsSet() bool {
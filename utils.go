@@ -13,7 +13,9 @@ import (
 
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/go-connections/nat"
 )
 
 var dockerSockFile = "/var/run/docker.sock"
@@ -53,22 +55,76 @@ func initializeMoldConfig(dirname string) error {
 	return err
 }
 
-// getBuildHash gets sha256 hash of a container config
-func getBuildHash(cfg *ContainerConfig) (string, error) {
-	if cfg == nil {
+// env. vars injected per run which would otherwise invalidate the build cache
+// on every commit
+var volatileEnvVars = []string{"APP_VERSION", "APP_VERSION_SHORT", "APP_COMMIT", "APP_COMMIT_INDEX", "APP_NEXT_VERSION", "APP_DIRTY"}
+
+// buildHashInput is the subset of the container config that determines the
+// contents of a build container
+type buildHashInput struct {
+	Image        string
+	Cmd          []string
+	WorkingDir   string
+	Env          []string
+	ExposedPorts nat.PortSet
+	Binds        []string
+	Mounts       []mount.Mount
+}
+
+// getBuildHash gets sha256 hash of a container config excluding volatile
+// values such as per run env. vars, names, volume names and the host path of
+// the build context which differs between checkouts
+func getBuildHash(cfg *ContainerConfig, context string) (string, error) {
+	if cfg == nil || cfg.Container == nil || cfg.Host == nil {
 		return "", fmt.Errorf("Invalid container config -- Empty config")
 	}
-	name := cfg.Name
-	cfg.Name = ""
-	b, err := json.Marshal(cfg)
+
+	isContext := func(src string) bool {
+		return context != "" && (src == context || src == toDockerWinPath(context))
+	}
+	in := buildHashInput{
+		Image:        cfg.Container.Image,
+		Cmd:          cfg.Container.Cmd,
+		WorkingDir:   cfg.Container.WorkingDir,
+		ExposedPorts: cfg.Container.ExposedPorts,
+	}
+	for _, b := range cfg.Host.Binds {
+		// the host path may contain a drive letter on windows
+		if i := strings.LastIndex(b, ":/"); i > 0 && isContext(b[:i]) {
+			b = b[i:]
+		}
+		in.Binds = append(in.Binds, b)
+	}
+	for _, e := range cfg.Container.Env {
+		if !isVolatileEnvVar(e) {
+			in.Env = append(in.Env, e)
+		}
+	}
+	for _, m := range cfg.Host.Mounts {
+		if m.Type == mount.TypeVolume || m.Type == mount.TypeBind && isContext(m.Source) {
+			m.Source = ""
+		}
+		in.Mounts = append(in.Mounts, m)
+	}
+
+	b, err := json.Marshal(in)
 	if err != nil {
 		return "", fmt.Errorf("The container config cannot be serialized to json: %s", err)
 	}
-	cfg.Name = name
 	h := sha256.Sum256(b)
 	return fmt.Sprintf("%x", h), nil
 }
 
+func isVolatileEnvVar(env string) bool {
+	name := strings.SplitN(env, "=", 2)[0]
+	for _, v := range volatileEnvVars {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
+
 // returns the name of the image.  it parses out the namespace and tag if provided
 func nameFromImageName(imageName string) string {
 	iparts := strings.Split(strings.Split(imageName, ":")[0], "/")
@@ -78,6 +134,31 @@ func nameFromImageName(imageName string) string {
 	return iparts[len(iparts)-1]
 }
 
+// returns the registry host of the image reference or an empty string for the
+// default registry.
+func imageRegistry(ref string) string {
+	pp := strings.SplitN(ref, "/", 2)
+	if len(pp) == 1 {
+		return ""
+	}
+	if strings.ContainsAny(pp[0], ".:") || pp[0] == "localhost" {
+		return pp[0]
+	}
+	return ""
+}
+
+// imageRepository returns the image reference without the tag or digest
+func imageRepository(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	// a colon after the last slash is the tag rather than the registry port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
 // Merges errors together
 func mergeErrors(err1, err2 error) error {
 	if err1 == nil {
@@ -97,6 +178,27 @@ func readMoldConfig(moldFile string) (*MoldConfig, error) {
 	return nil, err
 }
 
+// validateContextFile checks the file of the option is a path within the context
+func validateContextFile(option, file string) error {
+	if filepath.IsAbs(file) || strings.HasPrefix(filepath.Clean(file), "..") {
+		return fmt.Errorf("%s: file must be within the context: %s", option, file)
+	}
+	return nil
+}
+
+// readMoldConfigAtRef reads the mold file of the ref checked out or of the
+// working tree if nil
+func readMoldConfigAtRef(moldFile string, co *refCheckout) (*MoldConfig, error) {
+	if co == nil {
+		return readMoldConfig(moldFile)
+	}
+	d, err := ioutil.ReadFile(co.path(moldFile))
+	if err == nil {
+		return newMoldConfigAtRef(d, co)
+	}
+	return nil, err
+}
+
 func getEnvVars(envFile string) ([]string, error) {
 	fd, err := os.Open(envFile)
 	if err != nil {
@@ -192,15 +294,41 @@ Options:
 
   -app-version  Show the app version from git (default: 0.0.0)
 
+  -changelog    Show the changelog of the commits since the last tag grouped by
+                conventional commit type.
+
+  -changelog-range   Commit range <from>..<to> (default: <last tag>..HEAD)
+
+  -changelog-format  Changelog format markdown or json (default: markdown)
+
   -init         Initialize a new %s for the project if one does not exist.
 
   -var          Show value of vairable specified in the configuration file  (default: NA)
 
-  -uri          Docker URI          (default: %s)
+  -uri          Docker URI i.e. unix://, tcp:// or ssh://user@host (default: %s)
+                DOCKER_HOST is used if not specified.
+
+  -tlsverify    Use TLS and verify the daemon certificate. (env: DOCKER_TLS_VERIFY)
+
+  -tlscacert    CA certificate path.   (default: $DOCKER_CERT_PATH/ca.pem)
+
+  -tlscert      Client certificate path.   (default: $DOCKER_CERT_PATH/cert.pem)
+
+  -tlskey       Client key path.   (default: $DOCKER_CERT_PATH/key.pem)
+
+  -allow-dirty  Allow publishing and releasing from a working tree with uncommitted
+                changes.
+
+  -ref          Build a branch, tag or commit from a temporary checkout instead of
+                the working tree.  The checkout is removed afterwards.
+
+  -offline      Never pull images, overriding the pull policy of all containers.
+                Fails before starting if any image is not available locally.
 
   -f            Configuration file  (default: %s)
 
   -t            Target to build     (default: all)
+                Targets taking an argument are given as <target>/<arg>.
 
                 build       Only perform the build phase.
 
@@ -209,10 +337,29 @@ Options:
                             <image_name> would be that as specified in your
                             configuration.
 
-                publish     Only publish artifacts.  Specific artifacts can be published
-                            using publish/<image_name> as the target where
+                publish     Only publish artifacts to the registries whose publish
+                            conditions match the branch/tag.  Specific artifacts
+                            can be published to all their registries using
+                            publish/<image_name> as the target where
                             <image_name> would be that as specified in your
                             configuration.
 
+                cache       Manage build cache volumes of the project.
+                            cache/ls lists them (default) and cache/prune
+                            removes those no longer referenced by the
+                            configuration.
+
+                release     Run all phases then create an annotated git tag of the
+                            next version inferred from the conventional commits
+                            since the last tag.  The tag is not pushed.
+
+                export      Save the artifacts as files to the export path.
+                            Specific artifacts can be saved using
+                            export/<image_name> as the target.
+
+                promote     Push a published version of the artifacts to their
+                            promote registries without rebuilding using
+                            promote/<version> as the target.
+
 `, defaultBuildConfigName, *dockerURI, *buildFile)
 }
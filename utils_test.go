@@ -32,13 +32,13 @@ func Test_getBuildHash(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	bc, err := assembleBuildContainers(cfg)
+	bc, _, err := assembleBuildContainers(cfg, "")
 	if err != nil {
 		t.Fatal(err)
 	}
 	var hs []string
 	for _, cc := range bc {
-		h, err := getBuildHash(cc)
+		h, err := getBuildHash(cc, cfg.Context)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -62,3 +62,74 @@ func Test_toDockerWinPath(t *testing.T) {
 		t.Fatalf("expected %s, got %s\n", expectedPath, s)
 	}
 }
+
+func Test_getBuildHash_volatile(t *testing.T) {
+	cc := DefaultContainerConfig("alpine")
+	cc.Container.Env = []string{"FOO=bar", "APP_COMMIT=abcdef1"}
+	h1, err := getBuildHash(cc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Container.Env = []string{"FOO=bar", "APP_COMMIT=1234567"}
+	cc.Name = "other"
+	if h2, _ := getBuildHash(cc, ""); h1 != h2 {
+		t.Fatal("volatile values should not change the hash")
+	}
+	cc.Container.Env = []string{"FOO=baz"}
+	if h2, _ := getBuildHash(cc, ""); h1 == h2 {
+		t.Fatal("env change should change the hash")
+	}
+}
+
+func Test_getBuildHash_context(t *testing.T) {
+	cfg, err := readMoldConfig("testdata/mold9.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hs []string
+	for _, ctx := range []string{"/builds/job-1/app", "/tmp/mold-ref123/app"} {
+		cfg.Context = ctx
+		bc, _, err := assembleBuildContainers(cfg, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc[0].Host.Binds = []string{ctx + ":/src:ro", "/var/data:/data"}
+		h, err := getBuildHash(bc[0], ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs = append(hs, h)
+	}
+	if hs[0] != hs[1] {
+		t.Fatal("the path of the context should not change the hash")
+	}
+}
+
+func Test_imageRegistry(t *testing.T) {
+	for ref, reg := range map[string]string{
+		"alpine":                         "",
+		"library/alpine:3.6":             "",
+		"registry.example.com/app:1":     "registry.example.com",
+		"localhost:5000/app":             "localhost:5000",
+		"localhost/ns/app":               "localhost",
+		"registry.example.com/ns/app:v1": "registry.example.com",
+	} {
+		if got := imageRegistry(ref); got != reg {
+			t.Errorf("%s: want '%s' got '%s'", ref, reg, got)
+		}
+	}
+}
+
+func Test_imageRepository(t *testing.T) {
+	for ref, repo := range map[string]string{
+		"alpine":                                "alpine",
+		"library/alpine:3.6":                    "library/alpine",
+		"localhost:5000/app":                    "localhost:5000/app",
+		"localhost:5000/app:v1":                 "localhost:5000/app",
+		"registry.example.com/ns/app@sha256:ab": "registry.example.com/ns/app",
+	} {
+		if got := imageRepository(ref); got != repo {
+			t.Errorf("%s: want '%s' got '%s'", ref, repo, got)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Version strategies
+const (
+	versionDefault   = "default"    // <tag>-<distance>-<commit>
+	versionSemver    = "semver"     // <next patch>-dev.<distance>+<commit>
+	versionNextPatch = "next-patch" // <tag> with the patch bumped
+	versionNextMinor = "next-minor" // <tag> with the minor bumped
+	versionNextMajor = "next-major" // <tag> with the major bumped
+	versionBranch    = "branch"     // <tag>-<branch>.<distance>
+	versionTemplate  = "template"   // go template of versionInfo
+)
+
+// VersionConfig selects how the version is computed from the git history when
+// the commit is not tagged.
+type VersionConfig struct {
+	Strategy string `yaml:",omitempty"`
+	// go template used by the template strategy i.e. {{.Tag}}-rc.{{.Distance}}
+	Template string `yaml:",omitempty"`
+	// only follow the first parent of merges when looking for the latest tag
+	FirstParent bool `yaml:"first_parent,omitempty"`
+	// glob the latest tag must match i.e. v[0-9]*
+	Match string `yaml:",omitempty"`
+	// prefix of the tags stripped to get the version i.e. api/v.  Defaults to v
+	Prefix string `yaml:",omitempty"`
+	// only count commits touching these paths, relative to the project
+	Paths []string `yaml:",omitempty"`
+	// appended to the version when the working tree has uncommitted changes.
+	// Defaults to -dirty
+	DirtySuffix string `yaml:"dirty_suffix,omitempty"`
+
+	tmpl *template.Template
+}
+
+func (vc *VersionConfig) parse() error {
+	switch vc.Strategy {
+	case "":
+		vc.Strategy = versionDefault
+	case versionDefault, versionSemver, versionNextPatch, versionNextMinor, versionNextMajor, versionBranch:
+	case versionTemplate:
+		if vc.Template == "" {
+			return fmt.Errorf("versioning: template required")
+		}
+		t, err := template.New("version").Option("missingkey=error").Parse(vc.Template)
+		if err != nil {
+			return fmt.Errorf("versioning: %v", err)
+		}
+		// fail now rather than silently fall back to the default when formatting
+		sample := versionInfo{Tag: "1.2.3", Distance: 1, Commit: "abcdef0", Branch: "master", semver: parseSemver("1.2.3")}
+		if err = t.Execute(ioutil.Discard, sample); err != nil {
+			return fmt.Errorf("versioning: %v", err)
+		}
+		vc.tmpl = t
+	default:
+		return fmt.Errorf("versioning: invalid strategy: %s", vc.Strategy)
+	}
+	if vc.DirtySuffix == "" {
+		vc.DirtySuffix = "-dirty"
+	}
+	if vc.Prefix != "" && vc.Match == "" {
+		vc.Match = vc.Prefix + "*"
+	}
+	if _, err := path.Match(vc.Match, ""); err != nil {
+		return fmt.Errorf("versioning: match: %v", err)
+	}
+	return nil
+}
+
+// tagPrefix returns the prefix of version tags
+func (vc *VersionConfig) tagPrefix() string {
+	if vc.Prefix == "" {
+		return "v"
+	}
+	return vc.Prefix
+}
+
+// matchTag reports whether the tag name may be used to compute the version
+func (vc *VersionConfig) matchTag(name string) bool {
+	if vc.Match == "" {
+		return true
+	}
+	ok, _ := path.Match(vc.Match, name)
+	return ok
+}
+
+// versionInfo is the git state a version is computed from.  It is also the data
+// passed to the version template.
+type versionInfo struct {
+	Tag      string // latest tag without the v prefix
+	Distance int    // commits since the tag
+	Commit   string // short commit hash
+	Branch   string // sanitized branch name
+	semver
+}
+
+// format returns the version per the strategy.  A tagged commit is always its
+// tag.  Strategies needing a semantic version tag fall back to the default if
+// the tag is not one.
+func (vc *VersionConfig) format(vi versionInfo) string {
+	if vi.Commit == "" || vi.Distance == 0 {
+		return vi.Tag
+	}
+
+	switch vc.Strategy {
+	case versionSemver:
+		if vi.valid && vi.Pre != "" {
+			return fmt.Sprintf("%s.dev.%d+%s", vi.semver, vi.Distance, vi.Commit)
+		}
+		if vi.valid {
+			return fmt.Sprintf("%s-dev.%d+%s", vi.bump(versionNextPatch), vi.Distance, vi.Commit)
+		}
+
+	case versionNextPatch, versionNextMinor, versionNextMajor:
+		if vi.valid {
+			return vi.bump(vc.Strategy).String()
+		}
+
+	case versionBranch:
+		if vi.Branch != "" {
+			return fmt.Sprintf("%s-%s.%d", vi.Tag, vi.Branch, vi.Distance)
+		}
+
+	case versionTemplate:
+		var buf bytes.Buffer
+		if err := vc.tmpl.Execute(&buf, vi); err == nil {
+			return buf.String()
+		}
+	}
+
+	return fmt.Sprintf("%s-%d-%s", vi.Tag, vi.Distance, vi.Commit)
+}
+
+// semver is a parsed major.minor.patch[-prerelease] version
+type semver struct {
+	Major, Minor, Patch int
+	Pre                 string
+
+	valid bool
+}
+
+var semverRe = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+func parseSemver(s string) semver {
+	m := semverRe.FindStringSubmatch(s)
+	if m == nil {
+		return semver{}
+	}
+	sv := semver{Pre: m[4], valid: true}
+	sv.Major, _ = strconv.Atoi(m[1])
+	sv.Minor, _ = strconv.Atoi(m[2])
+	sv.Patch, _ = strconv.Atoi(m[3])
+	return sv
+}
+
+// bump returns the next version for the strategy.  A prerelease is released
+// as is rather than bumped.
+func (sv semver) bump(strategy string) semver {
+	next := semver{Major: sv.Major, Minor: sv.Minor, Patch: sv.Patch, valid: true}
+	if sv.Pre != "" {
+		return next
+	}
+	switch strategy {
+	case versionNextMajor:
+		next.Major++
+		next.Minor = 0
+		next.Patch = 0
+	case versionNextMinor:
+		next.Minor++
+		next.Patch = 0
+	default:
+		next.Patch++
+	}
+	return next
+}
+
+func (sv semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", sv.Major, sv.Minor, sv.Patch)
+	if sv.Pre != "" {
+		s += "-" + sv.Pre
+	}
+	return s
+}
+
+// conventionalRe matches the subject of a conventional commit i.e.
+// feat(api)!: remove v1 endpoints
+var conventionalRe = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?: (.*)$`)
+
+// parseConventional parses a commit message per the Conventional Commits spec.
+// The type is empty if the message does not follow it, in which case the
+// subject is the first line.
+func parseConventional(msg string) (typ, scope, subject string, breaking bool) {
+	subject = strings.TrimSpace(strings.SplitN(msg, "\n", 2)[0])
+	breaking = strings.Contains(msg, "BREAKING CHANGE:") || strings.Contains(msg, "BREAKING-CHANGE:")
+
+	m := conventionalRe.FindStringSubmatch(subject)
+	if m == nil {
+		return "", "", subject, breaking
+	}
+	return strings.ToLower(m[1]), m[2], m[4], breaking || m[3] == "!"
+}
+
+// conventionalBump returns the bump implied by the commit messages per the
+// Conventional Commits spec: major on a breaking change, minor on a feature
+// and patch otherwise.
+func conventionalBump(msgs []string) string {
+	bump := versionNextPatch
+	for _, msg := range msgs {
+		typ, _, _, breaking := parseConventional(msg)
+		if breaking {
+			return versionNextMajor
+		}
+		if typ == "feat" {
+			bump = versionNextMinor
+		}
+	}
+	return bump
+}
+
+var branchInvalidChars = regexp.MustCompile(`[^0-9A-Za-z-]+`)
+
+// sanitizeBranch makes the branch name usable as a version prerelease
+// identifier i.e. feature/x -> feature-x
+func sanitizeBranch(branch string) string {
+	return strings.Trim(branchInvalidChars.ReplaceAllString(branch, "-"), "-")
+}
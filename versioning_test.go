@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func Test_VersionConfig_format(t *testing.T) {
+	vi := versionInfo{Tag: "1.2.3", Distance: 5, Commit: "abcdef0", Branch: "feature-x", semver: parseSemver("1.2.3")}
+
+	for _, tc := range []struct {
+		cfg  VersionConfig
+		want string
+	}{
+		{VersionConfig{}, "1.2.3-5-abcdef0"},
+		{VersionConfig{Strategy: versionSemver}, "1.2.4-dev.5+abcdef0"},
+		{VersionConfig{Strategy: versionNextPatch}, "1.2.4"},
+		{VersionConfig{Strategy: versionNextMinor}, "1.3.0"},
+		{VersionConfig{Strategy: versionBranch}, "1.2.3-feature-x.5"},
+		{VersionConfig{Strategy: versionTemplate, Template: "{{.Major}}.{{.Minor}}.{{.Distance}}-{{.Branch}}"}, "1.2.5-feature-x"},
+	} {
+		if err := tc.cfg.parse(); err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.cfg.format(vi); got != tc.want {
+			t.Errorf("%s: want %s got %s", tc.cfg.Strategy, tc.want, got)
+		}
+
+		tagged := vi
+		tagged.Distance = 0
+		if got := tc.cfg.format(tagged); got != "1.2.3" {
+			t.Errorf("%s: tagged commit should be the tag: %s", tc.cfg.Strategy, got)
+		}
+	}
+
+	// the prerelease being prepared is continued
+	vc := VersionConfig{Strategy: versionSemver}
+	rc := versionInfo{Tag: "1.3.0-rc.1", Distance: 5, Commit: "abcdef0", semver: parseSemver("1.3.0-rc.1")}
+	if got := vc.format(rc); got != "1.3.0-rc.1.dev.5+abcdef0" {
+		t.Error("should continue the prerelease:", got)
+	}
+
+	// not a semantic version tag
+	if got := vc.format(versionInfo{Tag: "release", Distance: 1, Commit: "abcdef0"}); got != "release-1-abcdef0" {
+		t.Error("should fall back to default:", got)
+	}
+}
+
+func Test_VersionConfig_parse(t *testing.T) {
+	if err := (&VersionConfig{Strategy: "bogus"}).parse(); err == nil {
+		t.Error("should fail on invalid strategy")
+	}
+	if err := (&VersionConfig{Strategy: versionTemplate}).parse(); err == nil {
+		t.Error("should fail without template")
+	}
+	if err := (&VersionConfig{Strategy: versionTemplate, Template: "{{.Tag"}).parse(); err == nil {
+		t.Error("should fail on invalid template")
+	}
+	if err := (&VersionConfig{Strategy: versionTemplate, Template: "{{.Major}}.{{.Minr}}"}).parse(); err == nil {
+		t.Error("should fail on unknown field")
+	}
+}
+
+func Test_parseSemver(t *testing.T) {
+	if sv := parseSemver("v1.2.3-rc.1+build"); !sv.valid || sv.String() != "1.2.3-rc.1" {
+		t.Error("wrong version", sv)
+	}
+	if sv := parseSemver("1.2"); !sv.valid || sv.bump(versionNextPatch).String() != "1.2.1" {
+		t.Error("wrong version", sv)
+	}
+	if sv := parseSemver("1.2.3-rc.1"); sv.bump(versionNextMinor).String() != "1.2.3" {
+		t.Error("prerelease should be released as is", sv)
+	}
+	if sv := parseSemver("release-1"); sv.valid {
+		t.Error("should not be valid")
+	}
+	if b := sanitizeBranch("feature/JIRA_123"); b != "feature-JIRA-123" {
+		t.Error("wrong branch", b)
+	}
+}
+
+func Test_conventionalBump(t *testing.T) {
+	for want, msgs := range map[string][]string{
+		versionNextPatch: {"fix: a", "chore(deps): bump", "not conventional"},
+		versionNextMinor: {"fix: a", "feat: b"},
+		versionNextMajor: {"feat: a", "fix: b\n\nBREAKING CHANGE: removed c"},
+	} {
+		if got := conventionalBump(msgs); got != want {
+			t.Errorf("%v: want %s got %s", msgs, want, got)
+		}
+	}
+	if got := conventionalBump([]string{"feat(api)!: drop v1"}); got != versionNextMajor {
+		t.Error("! should be a major bump:", got)
+	}
+}